@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	metadataAllowLabel    = "ec2metaproxy.allow"
+	metadataDenyLabel     = "ec2metaproxy.deny"
+	metadataDisabledLabel = "ec2metaproxy.disabled"
+
+	// Path of the security credentials. The access rules for it also apply to
+	// the ECS and EKS Pod Identity credentials endpoints.
+	securityCredentialsPath = "meta-data/iam/security-credentials"
+)
+
+// Body of the 404 and 403 responses of the EC2 metadata service
+const imdsErrorPage = `<?xml version="1.0" encoding="iso-8859-1"?>
+<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN"
+	"http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en" lang="en">
+ <head>
+  <title>%[1]d - %[2]s</title>
+ </head>
+ <body>
+  <h1>%[1]d - %[2]s</h1>
+ </body>
+</html>
+`
+
+type metadataACLRule struct {
+	pattern string
+	allow   bool
+}
+
+// metadataACL decides which metadata paths a container can read. Patterns are
+// relative to meta-data, like override keys, and match the path and all paths
+// below it. A trailing * matches any path with the prefix. The longest
+// matching pattern wins. If patterns are the same length, the pattern added
+// last wins, so override rules take precedence over global rules and deny
+// patterns over allow patterns added at the same time. Paths that match no
+// pattern are allowed.
+//
+// The rules from the container labels are evaluated separately and a path
+// must be allowed by both, so an image can only narrow what the operator
+// allows.
+type metadataACL struct {
+	rules []metadataACLRule
+	// Rules from the container labels
+	containerRules []metadataACLRule
+	disabled       bool
+}
+
+func newMetadataACL(allow, deny []string) metadataACL {
+	var acl metadataACL
+	acl.Add(allow, deny)
+	return acl
+}
+
+func (a *metadataACL) Add(allow, deny []string) {
+	a.rules = appendACLRules(a.rules, allow, deny)
+}
+
+// AddContainer adds the rules from the container labels.
+func (a *metadataACL) AddContainer(allow, deny []string) {
+	a.containerRules = appendACLRules(a.containerRules, allow, deny)
+}
+
+func appendACLRules(rules []metadataACLRule, allow, deny []string) []metadataACLRule {
+	for _, pattern := range allow {
+		rules = append(rules, metadataACLRule{aclPattern(pattern), true})
+	}
+
+	for _, pattern := range deny {
+		rules = append(rules, metadataACLRule{aclPattern(pattern), false})
+	}
+
+	return rules
+}
+
+func aclPattern(pattern string) string {
+	if pattern == "*" {
+		return pattern
+	}
+
+	return overridePath(pattern)
+}
+
+// Allowed returns true if the container can read the path, which is relative
+// to the API version.
+func (a metadataACL) Allowed(subpath string) bool {
+	if a.disabled {
+		return false
+	}
+
+	subpath = strings.Trim(subpath, "/")
+	return aclAllowed(a.rules, subpath) && aclAllowed(a.containerRules, subpath)
+}
+
+func aclAllowed(rules []metadataACLRule, subpath string) bool {
+	allowed := true
+	matchLength := -1
+
+	for _, rule := range rules {
+		if !aclMatch(rule.pattern, subpath) {
+			continue
+		}
+
+		if len(rule.pattern) >= matchLength {
+			allowed = rule.allow
+			matchLength = len(rule.pattern)
+		}
+	}
+
+	return allowed
+}
+
+func aclMatch(pattern, subpath string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(subpath, strings.TrimSuffix(pattern, "*"))
+	}
+
+	return subpath == pattern || strings.HasPrefix(subpath, pattern+"/")
+}
+
+// splitACLPatterns splits a label value with patterns separated by commas or
+// whitespace.
+func splitACLPatterns(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
+
+func writeIMDSError(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, imdsErrorPage, status, http.StatusText(status))
+}
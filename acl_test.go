@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadataACLAllowed(t *testing.T) {
+	assert := assert.New(t)
+
+	acl := newMetadataACL([]string{"placement"}, []string{"user-data", "dynamic/instance-identity/*", "*"})
+
+	tests := []struct {
+		path    string
+		allowed bool
+	}{
+		{"meta-data/placement/availability-zone", true},
+		{"meta-data/placement/", true},
+		{"meta-data/hostname", false},
+		{"user-data", false},
+		{"dynamic/instance-identity/document", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(test.allowed, acl.Allowed(test.path), test.path)
+	}
+
+	acl = newMetadataACL(nil, []string{"user-data", "dynamic/instance-identity"})
+	assert.True(acl.Allowed("meta-data/hostname"))
+	assert.True(acl.Allowed("user-data-other"))
+	assert.False(acl.Allowed("user-data"))
+	assert.False(acl.Allowed("dynamic/instance-identity/signature"))
+
+	// Deny wins for patterns of the same length added at the same time
+	acl = newMetadataACL([]string{"hostname"}, []string{"hostname"})
+	assert.False(acl.Allowed("meta-data/hostname"))
+}
+
+func TestMetadataProxyAuthorize(t *testing.T) {
+	assert := assert.New(t)
+
+	platform := testContainerService{
+		"172.17.0.2": {ID: "container-a", Labels: map[string]string{"ec2metaproxy.deny": "placement, hostname"}},
+		"172.17.0.3": {ID: "container-b", Labels: map[string]string{"ec2metaproxy.disabled": "true"}},
+		"172.17.0.4": {ID: "container-c", Labels: map[string]string{"ec2metaproxy.allow": "user-data"}},
+		"172.17.0.5": {ID: "container-d", Labels: map[string]string{"ec2metaproxy.deny": "placement", "ec2metaproxy.allow": "placement/region"}},
+		"172.17.0.6": {ID: "container-e", Labels: map[string]string{"tier": "bootstrap"}},
+	}
+	config := newTestConfig()
+	testConfigure(config, func(cfg *reloadableConfig) {
+		cfg.MetadataACL = newMetadataACL(nil, []string{"user-data"})
+		cfg.Overrides = &metadataOverrides{rules: []metadataOverrideRule{
+			{Labels: map[string]string{"tier": "bootstrap"}, Allow: []string{"user-data"}},
+		}}
+	})
+	proxy := newMetadataProxy("http://169.254.169.254", &http.Transport{}, platform, config)
+
+	authorize := func(w http.ResponseWriter, r *http.Request) {
+		if proxy.Authorize(w, r) {
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+
+	assert.Equal(http.StatusOK, testRequest(authorize, "GET", "/latest/meta-data/ami-id", "172.17.0.2").Code)
+	assert.Equal(http.StatusNotFound, testRequest(authorize, "GET", "/latest/meta-data/placement/region", "172.17.0.2").Code)
+	assert.Equal(http.StatusNotFound, testRequest(authorize, "GET", "/latest/meta-data/hostname", "172.17.0.2").Code)
+	assert.Equal(http.StatusNotFound, testRequest(authorize, "GET", "/latest/user-data", "172.17.0.2").Code)
+	assert.Equal(http.StatusOK, testRequest(authorize, "GET", "/latest/api/token", "172.17.0.2").Code)
+
+	w := testRequest(authorize, "GET", "/latest/meta-data/ami-id", "172.17.0.3")
+	assert.Equal(http.StatusForbidden, w.Code)
+	assert.True(strings.Contains(w.Body.String(), "<title>403 - Forbidden</title>"))
+	assert.Equal(http.StatusForbidden, testRequest(authorize, "GET", "/latest/api/token", "172.17.0.3").Code)
+
+	// Container labels can not allow paths the operator denies
+	assert.Equal(http.StatusNotFound, testRequest(authorize, "GET", "/latest/user-data", "172.17.0.4").Code)
+	assert.Equal(http.StatusOK, testRequest(authorize, "GET", "/latest/meta-data/ami-id", "172.17.0.4").Code)
+
+	// but can allow paths below the paths they deny
+	assert.Equal(http.StatusOK, testRequest(authorize, "GET", "/latest/meta-data/placement/region", "172.17.0.5").Code)
+	assert.Equal(http.StatusNotFound, testRequest(authorize, "GET", "/latest/meta-data/placement/availability-zone", "172.17.0.5").Code)
+
+	// Override rules take precedence over global rules
+	assert.Equal(http.StatusOK, testRequest(authorize, "GET", "/latest/user-data", "172.17.0.6").Code)
+
+	testConfigure(config, func(cfg *reloadableConfig) { cfg.MetadataDeniedStatus = http.StatusForbidden })
+	assert.Equal(http.StatusForbidden, testRequest(authorize, "GET", "/latest/meta-data/hostname", "172.17.0.2").Code)
+}
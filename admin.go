@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	adminContainersPath = "/containers"
+	adminSyncPath       = "/sync"
+	adminConfigPath     = "/config"
+	adminStatsPath      = "/stats"
+
+	// Prefix of an admin server address that is a unix socket
+	unixAddrPrefix = "unix:"
+)
+
+// Flags with values that must not be shown by the admin API
+var secretFlags = map[string]bool{
+	"static-secret-access-key": true,
+	"static-session-token":     true,
+}
+
+// adminContainer is the state of a container as seen by the proxy. It never
+// contains credentials.
+type adminContainer struct {
+	ID           string              `json:"id"`
+	Name         string              `json:"name"`
+	Image        string              `json:"image,omitempty"`
+	IPAddress    string              `json:"ip_address"`
+	Roles        []string            `json:"roles,omitempty"`
+	RoleBehavior string              `json:"role_behavior,omitempty"`
+	PolicyHash   string              `json:"policy_hash,omitempty"`
+	Error        string              `json:"error,omitempty"`
+	Credentials  []credentialsStatus `json:"credentials"`
+}
+
+// adminHandler serves the admin API, which shows what the proxy believes about
+// the containers and can evict cached credentials. Requests must carry the
+// admin token as a bearer token.
+type adminHandler struct {
+	platform    containerService
+	credentials *credentialsProvider
+	token       string
+	// Returns the effective configuration for /config
+	config func() interface{}
+	// nil if the metadata snapshot is disabled
+	snapshot *metadataSnapshot
+	mux      *http.ServeMux
+	// Paths that do not require the admin token
+	public map[string]bool
+}
+
+func newAdminHandler(platform containerService, credentials *credentialsProvider, token string, config func() interface{}) *adminHandler {
+	a := &adminHandler{
+		platform:    platform,
+		credentials: credentials,
+		token:       token,
+		config:      config,
+		mux:         http.NewServeMux(),
+		public:      make(map[string]bool),
+	}
+
+	a.mux.HandleFunc(adminContainersPath, a.HandleContainers)
+	a.mux.HandleFunc(adminContainersPath+"/", a.HandleContainer)
+	a.mux.HandleFunc(adminSyncPath, a.HandleSync)
+	a.mux.HandleFunc(adminConfigPath, a.HandleConfig)
+	a.mux.HandleFunc(adminStatsPath, a.HandleStats)
+	return a
+}
+
+// HandlePublic adds a handler that does not require the admin token, such as
+// a health check.
+func (a *adminHandler) HandlePublic(path string, handler http.HandlerFunc) {
+	a.mux.HandleFunc(path, handler)
+	a.public[path] = true
+}
+
+// readAdminToken reads the admin token from a file. The token is required
+// unless the admin server is a unix socket, which is protected by its file
+// permissions.
+func readAdminToken(addr, tokenFile string) (string, error) {
+	if len(tokenFile) == 0 {
+		if strings.HasPrefix(addr, unixAddrPrefix) {
+			return "", nil
+		}
+
+		return "", fmt.Errorf("Admin token file is required for admin server %s", addr)
+	}
+
+	data, err := ioutil.ReadFile(tokenFile)
+
+	if err != nil {
+		return "", err
+	}
+
+	token := strings.TrimSpace(string(data))
+
+	if len(token) < 16 {
+		return "", fmt.Errorf("Admin token in %s must be at least 16 bytes", tokenFile)
+	}
+
+	return token, nil
+}
+
+// listen opens a TCP listener, or a unix socket if addr starts with unix:.
+// Unix sockets are only accessible by the owner.
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixAddrPrefix) {
+		return net.Listen("tcp", addr)
+	}
+
+	path := strings.TrimPrefix(addr, unixAddrPrefix)
+
+	// Remove the socket of a previous process
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+func (a *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(a.token) > 0 && !a.public[r.URL.Path] {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	a.mux.ServeHTTP(w, r)
+}
+
+// HandleContainers lists the known containers.
+func (a *adminHandler) HandleContainers(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+
+	containers := []adminContainer{}
+
+	for _, container := range a.platform.Containers() {
+		containers = append(containers, a.container(container))
+	}
+
+	writeJSON(w, containers)
+}
+
+// HandleContainer serves /containers/<ip>, /containers/<ip>/evict and
+// /containers/<ip>/refresh.
+func (a *adminHandler) HandleContainer(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, adminContainersPath+"/"), "/", 2)
+	containerIP, action := parts[0], ""
+
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+
+	switch action {
+	case "":
+		if !requireMethod(w, r, "GET") {
+			return
+		}
+
+		container, err := a.platform.ContainerForIP(containerIP)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		writeJSON(w, a.container(container))
+	case "evict":
+		if !requireMethod(w, r, "POST") {
+			return
+		}
+
+		count := a.credentials.Evict(containerIP)
+		log.Infof("Evicted %d credentials of container %s", count, containerIP)
+		writeJSON(w, map[string]int{"evicted": count})
+	case "refresh":
+		if !requireMethod(w, r, "POST") {
+			return
+		}
+
+		container, err := a.platform.ContainerForIP(containerIP)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		a.credentials.Evict(containerIP)
+		roles, err := a.credentials.RoleNamesForIP(containerIP)
+
+		for _, role := range roles {
+			if _, err = a.credentials.CredentialsForRole(containerIP, role); err != nil {
+				break
+			}
+		}
+
+		result := a.container(container)
+
+		if err != nil && err != errNoCredentials && err != errInstanceProfile {
+			log.Error("Error refreshing credentials of container ", containerIP, ": ", err)
+			result.Error = err.Error()
+		}
+
+		writeJSON(w, result)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// HandleSync refreshes the known containers from the container manager.
+func (a *adminHandler) HandleSync(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "POST") {
+		return
+	}
+
+	a.platform.Sync()
+	writeJSON(w, map[string]int{"containers": len(a.platform.Containers())})
+}
+
+// HandleConfig returns the effective configuration.
+func (a *adminHandler) HandleConfig(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+
+	writeJSON(w, a.config())
+}
+
+// HandleStats returns counters of the proxy, such as the number of responses
+// served from the metadata snapshot while the metadata service was
+// unavailable.
+func (a *adminHandler) HandleStats(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+
+	stats := map[string]interface{}{}
+
+	if a.snapshot != nil {
+		stats["metadata_snapshot"] = a.snapshot.Stats()
+	}
+
+	writeJSON(w, stats)
+}
+
+func (a *adminHandler) container(container containerInfo) adminContainer {
+	result := adminContainer{
+		ID:          container.ID,
+		Name:        container.Name,
+		Image:       container.Image,
+		IPAddress:   container.IPAddress,
+		Credentials: a.credentials.CachedCredentials(container.IPAddress),
+	}
+
+	if result.Credentials == nil {
+		result.Credentials = []credentialsStatus{}
+	}
+
+	roles, iamPolicy, err := a.credentials.ContainerRoles(container)
+
+	switch {
+	case err == errNoCredentials:
+		result.RoleBehavior = noRoleNone
+	case err == errInstanceProfile:
+		result.RoleBehavior = noRoleInstanceProfile
+	case err != nil:
+		result.Error = err.Error()
+	}
+
+	for _, role := range roles {
+		result.Roles = append(result.Roles, role.String())
+	}
+
+	result.PolicyHash = policyHash(iamPolicy)
+	return result
+}
+
+func requireMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+
+	return true
+}
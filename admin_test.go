@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	platform := testContainerService{
+		"172.17.0.2": {ID: "container-a", Name: "a", IamPolicy: `{"Statement":[]}`},
+		"172.17.0.3": {ID: "container-b", Name: "b", NoRoleBehavior: noRoleNone},
+	}
+	credentials := newTestCredentialsProvider(platform)
+	admin := newAdminHandler(platform, credentials, "0123456789abcdef", func() interface{} {
+		return map[string]string{"server": ":18000"}
+	})
+	auth := "Authorization: Bearer 0123456789abcdef"
+
+	assert.Equal(http.StatusUnauthorized, testRequest(admin.ServeHTTP, "GET", "/containers", "").Code)
+	assert.Equal(http.StatusUnauthorized, testRequest(admin.ServeHTTP, "GET", "/containers", "", "Authorization: Bearer wrong").Code)
+	assert.Equal(http.StatusMethodNotAllowed, testRequest(admin.ServeHTTP, "POST", "/containers", "", auth).Code)
+
+	_, err := credentials.CredentialsForIP("172.17.0.2")
+	assert.Nil(err)
+
+	w := testRequest(admin.ServeHTTP, "GET", "/containers", "", auth)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.NotContains(w.Body.String(), "SECRET")
+
+	var containers []adminContainer
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &containers))
+	assert.Len(containers, 2)
+	assert.Equal("container-a", containers[0].ID)
+	assert.Equal("172.17.0.2", containers[0].IPAddress)
+	assert.Equal([]string{"arn:aws:iam::123456789012:role/test-role-name"}, containers[0].Roles)
+	assert.Equal(policyHash(`{"Statement":[]}`), containers[0].PolicyHash)
+	assert.Len(containers[0].Credentials, 1)
+	assert.Equal(noRoleNone, containers[1].RoleBehavior)
+	assert.Len(containers[1].Credentials, 0)
+
+	assert.Equal(http.StatusNotFound, testRequest(admin.ServeHTTP, "GET", "/containers/172.17.0.9", "", auth).Code)
+	assert.Equal(http.StatusMethodNotAllowed, testRequest(admin.ServeHTTP, "GET", "/containers/172.17.0.2/evict", "", auth).Code)
+
+	w = testRequest(admin.ServeHTTP, "POST", "/containers/172.17.0.2/evict", "", auth)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`{"evicted":1}`, w.Body.String())
+	assert.Len(credentials.CachedCredentials("172.17.0.2"), 0)
+
+	w = testRequest(admin.ServeHTTP, "POST", "/containers/172.17.0.2/refresh", "", auth)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Len(credentials.CachedCredentials("172.17.0.2"), 1)
+
+	w = testRequest(admin.ServeHTTP, "GET", "/config", "", auth)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.True(strings.Contains(w.Body.String(), `"server":":18000"`))
+
+	assert.Equal(`{}`, testRequest(admin.ServeHTTP, "GET", "/stats", "", auth).Body.String())
+
+	admin.snapshot, err = newMetadataSnapshot("")
+	assert.Nil(err)
+	admin.snapshot.Record("meta-data/instance-id", "text/plain", []byte("i-1234"))
+	admin.snapshot.Response("meta-data/instance-id")
+	assert.Equal(`{"metadata_snapshot":{"paths":1,"served":1}}`, testRequest(admin.ServeHTTP, "GET", "/stats", "", auth).Body.String())
+}
+
+func TestReadAdminToken(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := readAdminToken("127.0.0.1:18001", "")
+	assert.NotNil(err)
+
+	token, err := readAdminToken("unix:/run/ec2metaproxy.sock", "")
+	assert.Nil(err)
+	assert.Equal("", token)
+}
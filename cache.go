@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMetadataCacheTTL = time.Hour
+	metadataCacheSweep      = time.Minute
+)
+
+var (
+	// Metadata paths that do not change while the instance is running
+	defaultMetadataCachePaths = []string{
+		"ami-id",
+		"ami-launch-index",
+		"ami-manifest-path",
+		"block-device-mapping",
+		"hostname",
+		"instance-id",
+		"instance-type",
+		"local-hostname",
+		"local-ipv4",
+		"mac",
+		"placement",
+		"product-codes",
+		"reservation-id",
+		"services",
+		"dynamic/instance-identity",
+	}
+
+	// Metadata paths that change while the instance is running. They are never
+	// cached, even if a cache TTL is configured for them.
+	uncachedMetadataPaths = []string{
+		"autoscaling",
+		"events",
+		"iam",
+		"rebalance",
+		"spot",
+		"tags",
+	}
+)
+
+type metadataCacheRule struct {
+	pattern string
+	ttl     time.Duration
+}
+
+type cachedResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func (c *cachedResponse) Response() *http.Response {
+	header := make(http.Header)
+	copyHeaders(header, c.header)
+
+	return &http.Response{
+		Status:        http.StatusText(c.status),
+		StatusCode:    c.status,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(c.body)),
+		ContentLength: int64(len(c.body)),
+	}
+}
+
+type metadataCacheCall struct {
+	done     sync.WaitGroup
+	response *cachedResponse
+	err      error
+}
+
+// metadataCache caches successful responses of the EC2 metadata service for
+// paths with a TTL. Concurrent requests for the same key share one request to
+// the metadata service.
+type metadataCache struct {
+	rules     []metadataCacheRule
+	entries   map[string]*cachedResponse
+	pending   map[string]*metadataCacheCall
+	nextSweep time.Time
+	lock      sync.Mutex
+	now       func() time.Time
+}
+
+// newMetadataCache creates a cache for the default immutable paths and the
+// given paths. Paths use the same patterns as the access rules. A TTL of 0
+// disables caching of a path.
+func newMetadataCache(ttls map[string]time.Duration) *metadataCache {
+	cache := &metadataCache{
+		entries: make(map[string]*cachedResponse),
+		pending: make(map[string]*metadataCacheCall),
+		now:     time.Now,
+	}
+
+	for _, path := range defaultMetadataCachePaths {
+		cache.rules = append(cache.rules, metadataCacheRule{aclPattern(path), defaultMetadataCacheTTL})
+	}
+
+	for path, ttl := range ttls {
+		cache.rules = append(cache.rules, metadataCacheRule{aclPattern(path), ttl})
+	}
+
+	return cache
+}
+
+// TTL returns how long responses for the path, relative to the API version,
+// are cached. Zero if the path is not cached.
+func (c *metadataCache) TTL(subpath string) time.Duration {
+	subpath = strings.Trim(subpath, "/")
+
+	for _, path := range uncachedMetadataPaths {
+		if aclMatch(aclPattern(path), subpath) {
+			return 0
+		}
+	}
+
+	var ttl time.Duration
+	matchLength := -1
+
+	for _, rule := range c.rules {
+		if aclMatch(rule.pattern, subpath) && len(rule.pattern) >= matchLength {
+			ttl = rule.ttl
+			matchLength = len(rule.pattern)
+		}
+	}
+
+	return ttl
+}
+
+// Do returns the cached response for the key or calls fetch to get it. Only
+// responses with status 200 are cached.
+func (c *metadataCache) Do(key string, ttl time.Duration, fetch func() (*http.Response, error)) (*http.Response, error) {
+	c.lock.Lock()
+	now := c.now()
+
+	if now.After(c.nextSweep) {
+		c.sweep(now)
+	}
+
+	if entry, found := c.entries[key]; found && now.Before(entry.expires) {
+		c.lock.Unlock()
+		return entry.Response(), nil
+	}
+
+	if call, found := c.pending[key]; found {
+		c.lock.Unlock()
+		call.done.Wait()
+
+		if call.err != nil {
+			return nil, call.err
+		}
+
+		return call.response.Response(), nil
+	}
+
+	call := &metadataCacheCall{}
+	call.done.Add(1)
+	c.pending[key] = call
+	c.lock.Unlock()
+
+	call.response, call.err = readResponse(fetch())
+
+	c.lock.Lock()
+	delete(c.pending, key)
+
+	if call.err == nil && call.response.status == http.StatusOK {
+		call.response.expires = c.now().Add(ttl)
+		c.entries[key] = call.response
+	}
+
+	c.lock.Unlock()
+	call.done.Done()
+
+	if call.err != nil {
+		return nil, call.err
+	}
+
+	return call.response.Response(), nil
+}
+
+// sweep removes expired entries. The lock must be held.
+func (c *metadataCache) sweep(now time.Time) {
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+
+	c.nextSweep = now.Add(metadataCacheSweep)
+}
+
+func readResponse(resp *http.Response, err error) (*cachedResponse, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &cachedResponse{
+		status: resp.StatusCode,
+		header: resp.Header,
+		body:   body,
+	}, nil
+}
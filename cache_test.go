@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadataCacheTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := newMetadataCache(map[string]time.Duration{
+		"placement/region": 5 * time.Minute,
+		"hostname":         0,
+		"spot/*":           time.Hour,
+	})
+
+	assert.Equal(time.Hour, cache.TTL("meta-data/instance-id"))
+	assert.Equal(time.Hour, cache.TTL("meta-data/placement/availability-zone"))
+	assert.Equal(5*time.Minute, cache.TTL("meta-data/placement/region"))
+	assert.Equal(time.Hour, cache.TTL("dynamic/instance-identity/document"))
+	assert.Equal(time.Duration(0), cache.TTL("meta-data/hostname"))
+	assert.Equal(time.Duration(0), cache.TTL("meta-data/spot/instance-action"))
+	assert.Equal(time.Duration(0), cache.TTL("meta-data/events/maintenance/scheduled"))
+	assert.Equal(time.Duration(0), cache.TTL("meta-data/iam/security-credentials/"))
+	assert.Equal(time.Duration(0), cache.TTL("user-data"))
+}
+
+func TestMetadataCacheDo(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	cache := newMetadataCache(nil)
+	cache.now = func() time.Time { return now }
+
+	var calls int32
+	status := http.StatusOK
+	release := make(chan bool)
+
+	fetch := func() (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return &http.Response{
+			StatusCode: status,
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body:       ioutil.NopCloser(strings.NewReader("i-1234")),
+		}, nil
+	}
+
+	// Concurrent misses share one request
+	var wg sync.WaitGroup
+
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			resp, err := cache.Do("instance-id", time.Minute, fetch)
+			assert.Nil(err)
+			body, _ := ioutil.ReadAll(resp.Body)
+			assert.Equal("i-1234", string(body))
+		}()
+	}
+
+	// Wait for the first request to start
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	wg.Wait()
+	assert.Equal(int32(1), atomic.LoadInt32(&calls))
+
+	resp, err := cache.Do("instance-id", time.Minute, fetch)
+	assert.Nil(err)
+	assert.Equal("text/plain", resp.Header.Get("Content-Type"))
+	assert.Equal(int32(1), atomic.LoadInt32(&calls))
+
+	// Expired
+	now = now.Add(2 * time.Minute)
+	_, err = cache.Do("instance-id", time.Minute, fetch)
+	assert.Nil(err)
+	assert.Equal(int32(2), atomic.LoadInt32(&calls))
+
+	// Errors are not cached
+	status = http.StatusUnauthorized
+	resp, err = cache.Do("other", time.Minute, fetch)
+	assert.Nil(err)
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+	cache.Do("other", time.Minute, fetch)
+	assert.Equal(int32(4), atomic.LoadInt32(&calls))
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	log "github.com/cihub/seelog"
+)
+
+// Flags that are applied again when the configuration file is reloaded. Other
+// flags only change when the proxy restarts.
+var reloadableFlags = map[string]bool{
+	"default-iam-role":           true,
+	"default-iam-policy":         true,
+	"allowed-role":               true,
+	"no-role-behavior":           true,
+	"allow-instance-profile":     true,
+	"share-credentials":          true,
+	"session-duration":           true,
+	"metadata-overrides-file":    true,
+	"metadata-allow":             true,
+	"metadata-deny":              true,
+	"metadata-denied-status":     true,
+	"container-network-identity": true,
+}
+
+// configValues are raw flag values by flag name. Repeated flags have more
+// than one value.
+type configValues map[string][]string
+
+// readConfigFile reads a JSON object with flag names as keys. Values are
+// strings, numbers or booleans, arrays of them for repeated flags or objects
+// for flags of KEY=VALUE pairs.
+func readConfigFile(path string) (configValues, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("Error parsing configuration file %s: %s", path, err)
+	}
+
+	values := make(configValues)
+
+	for name, value := range raw {
+		switch v := value.(type) {
+		case []interface{}:
+			values[name] = []string{}
+
+			for _, element := range v {
+				s, ok := configScalar(element)
+
+				if !ok {
+					return nil, fmt.Errorf("Invalid value for %s in configuration file %s", name, path)
+				}
+
+				values[name] = append(values[name], s)
+			}
+		case map[string]interface{}:
+			var keys []string
+
+			for key := range v {
+				keys = append(keys, key)
+			}
+
+			sort.Strings(keys)
+			values[name] = []string{}
+
+			for _, key := range keys {
+				s, ok := configScalar(v[key])
+
+				if !ok {
+					return nil, fmt.Errorf("Invalid value for %s in configuration file %s", name, path)
+				}
+
+				values[name] = append(values[name], key+"="+s)
+			}
+		default:
+			s, ok := configScalar(v)
+
+			if !ok {
+				return nil, fmt.Errorf("Invalid value for %s in configuration file %s", name, path)
+			}
+
+			values[name] = []string{s}
+		}
+	}
+
+	return values, nil
+}
+
+func configScalar(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
+
+// configFlags returns the global flags and the flags of the command by name.
+func configFlags(app *kingpin.Application, command string) map[string]*kingpin.FlagModel {
+	model := app.Model()
+	flags := make(map[string]*kingpin.FlagModel)
+
+	for _, flag := range model.Flags {
+		flags[flag.Name] = flag
+	}
+
+	for _, cmd := range model.Commands {
+		if cmd.FullCommand == command {
+			for _, flag := range cmd.Flags {
+				flags[flag.Name] = flag
+			}
+		}
+	}
+
+	return flags
+}
+
+// Prefix of the environment variables that set flags, e.g.
+// EC2METAPROXY_DEFAULT_IAM_ROLE for --default-iam-role
+const configEnvarPrefix = "EC2METAPROXY_"
+
+func flagEnvar(name string) string {
+	return configEnvarPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// explicitFlagValues returns the values of the flags that are given on the
+// command line and the values of the other flags that are given in
+// environment variables. They take precedence over the configuration file.
+func explicitFlagValues(app *kingpin.Application, args []string, flags map[string]*kingpin.FlagModel) (commandLine, env configValues, err error) {
+	context, err := app.ParseContext(args)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	commandLine = make(configValues)
+	env = make(configValues)
+
+	for _, element := range context.Elements {
+		if flag, ok := element.Clause.(*kingpin.FlagClause); ok && element.Value != nil {
+			name := flag.Model().Name
+			commandLine[name] = append(commandLine[name], *element.Value)
+		}
+	}
+
+	for name, flag := range flags {
+		if _, found := commandLine[name]; found || name == "help" {
+			continue
+		}
+
+		if value := os.Getenv(flagEnvar(name)); len(value) > 0 {
+			// Repeated flags are separated by new lines
+			if isCumulative(flag) {
+				env[name] = strings.Split(value, "\n")
+			} else {
+				env[name] = []string{value}
+			}
+		}
+	}
+
+	return commandLine, env, nil
+}
+
+// isCumulative returns true if the flag can be repeated.
+func isCumulative(flag *kingpin.FlagModel) bool {
+	v, ok := flag.Value.(interface {
+		IsCumulative() bool
+	})
+
+	return ok && v.IsCumulative()
+}
+
+// validateConfig returns an error if the configuration file sets a flag that
+// does not exist or can not be set in the file.
+func validateConfig(flags map[string]*kingpin.FlagModel, values configValues) error {
+	for name := range values {
+		if _, found := flags[name]; !found || name == "config-file" || name == "help" {
+			return fmt.Errorf("Unknown flag %s in configuration file", name)
+		}
+	}
+
+	return nil
+}
+
+// setFlags sets the flags to the values, except for the flags in skip.
+func setFlags(flags map[string]*kingpin.FlagModel, values, skip configValues) error {
+	for name, flagValues := range values {
+		if _, found := skip[name]; found {
+			continue
+		}
+
+		for _, value := range flagValues {
+			if err := flags[name].Value.Set(value); err != nil {
+				return fmt.Errorf("Invalid value for %s: %s", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// reloadableConfig holds the settings of the reloadable flags.
+type reloadableConfig struct {
+	DefaultIamRole       roleArn
+	DefaultIamPolicy     string
+	AllowedRoles         rolePatterns
+	NoRoleBehavior       string
+	AllowInstanceProfile bool
+	ShareCredentials     bool
+	SessionDuration      time.Duration
+	Overrides            *metadataOverrides
+	MetadataACL          metadataACL
+	MetadataDeniedStatus int
+	NetworkIdentity      bool
+	// Raw values of the reloadable flags the settings were parsed from
+	Flags configValues
+}
+
+// ContainerACL returns the metadata access rules of the container.
+func (cfg *reloadableConfig) ContainerACL(container containerInfo) metadataACL {
+	return cfg.Overrides.ACL(container, cfg.MetadataACL)
+}
+
+// liveConfig holds the reloadable configuration that is applied. A reload
+// replaces the configuration as a whole, so the credentials provider and the
+// metadata proxy switch to the new configuration at the same time.
+type liveConfig struct {
+	value atomic.Value
+}
+
+func newLiveConfig(cfg reloadableConfig) *liveConfig {
+	live := &liveConfig{}
+	live.Store(cfg)
+	return live
+}
+
+// Load returns the applied configuration, which must not be modified.
+func (l *liveConfig) Load() *reloadableConfig {
+	return l.value.Load().(*reloadableConfig)
+}
+
+// Store applies a new configuration.
+func (l *liveConfig) Store(cfg reloadableConfig) {
+	l.value.Store(&cfg)
+}
+
+// newReloadableConfig parses the values of the reloadable flags. value returns
+// the raw values of a flag.
+func newReloadableConfig(value func(name string) []string) (cfg reloadableConfig, err error) {
+	last := func(name string) string {
+		values := value(name)
+
+		if len(values) == 0 {
+			return ""
+		}
+
+		return values[len(values)-1]
+	}
+
+	parseBool := func(name string) bool {
+		if err != nil || len(last(name)) == 0 {
+			return false
+		}
+
+		var b bool
+
+		if b, err = strconv.ParseBool(last(name)); err != nil {
+			err = fmt.Errorf("Invalid value for %s: %s", name, last(name))
+		}
+
+		return b
+	}
+
+	cfg.Flags = make(configValues)
+
+	for name := range reloadableFlags {
+		cfg.Flags[name] = value(name)
+	}
+
+	if v := last("default-iam-role"); len(v) > 0 {
+		if cfg.DefaultIamRole, err = newRoleArn(v); err != nil {
+			return cfg, fmt.Errorf("Invalid value for default-iam-role: %s", v)
+		}
+	}
+
+	cfg.DefaultIamPolicy = last("default-iam-policy")
+	cfg.AllowedRoles = value("allowed-role")
+
+	switch cfg.NoRoleBehavior = last("no-role-behavior"); cfg.NoRoleBehavior {
+	case noRoleNone, noRoleInstanceProfile:
+	default:
+		return cfg, fmt.Errorf("Invalid value for no-role-behavior: %s", cfg.NoRoleBehavior)
+	}
+
+	cfg.AllowInstanceProfile = parseBool("allow-instance-profile")
+	cfg.ShareCredentials = parseBool("share-credentials")
+	cfg.NetworkIdentity = parseBool("container-network-identity")
+
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.SessionDuration, err = time.ParseDuration(last("session-duration")); err != nil {
+		return cfg, fmt.Errorf("Invalid value for session-duration: %s", last("session-duration"))
+	}
+
+	if cfg.SessionDuration < minSessionDuration || cfg.SessionDuration > maxSessionDuration {
+		return cfg, fmt.Errorf("Invalid value for session-duration: %s, must be between %s and %s", last("session-duration"), minSessionDuration, maxSessionDuration)
+	}
+
+	if cfg.Overrides, err = newMetadataOverrides(last("metadata-overrides-file")); err != nil {
+		return cfg, err
+	}
+
+	cfg.MetadataACL = newMetadataACL(value("metadata-allow"), value("metadata-deny"))
+
+	switch v := last("metadata-denied-status"); v {
+	case "403", "404":
+		cfg.MetadataDeniedStatus, _ = strconv.Atoi(v)
+	default:
+		return cfg, fmt.Errorf("Invalid value for metadata-denied-status: %s", v)
+	}
+
+	return cfg, nil
+}
+
+// configLoader loads the configuration file. When the file is reloaded, the
+// reloadable flags that are not given explicitly are set to the values in the
+// file or their defaults.
+type configLoader struct {
+	file     string
+	flags    map[string]*kingpin.FlagModel
+	explicit configValues
+	// Values of the last configuration file that was applied
+	values  configValues
+	modTime time.Time
+	lock    sync.Mutex
+}
+
+// newConfigLoader sets the flags that are not given on the command line to the
+// values of their environment variables and then the flags that are not given
+// in either to the values in the configuration file, if there is one.
+func newConfigLoader(app *kingpin.Application, args []string, command, file string) (*configLoader, error) {
+	flags := configFlags(app, command)
+	commandLine, env, err := explicitFlagValues(app, args, flags)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setFlags(flags, env, nil); err != nil {
+		return nil, err
+	}
+
+	explicit := make(configValues)
+
+	for _, values := range []configValues{commandLine, env} {
+		for name, value := range values {
+			explicit[name] = value
+		}
+	}
+
+	loader := &configLoader{
+		file:     file,
+		flags:    flags,
+		explicit: explicit,
+		values:   make(configValues),
+	}
+
+	if len(file) == 0 {
+		return loader, nil
+	}
+
+	if loader.modTime, err = modTime(file); err != nil {
+		return nil, err
+	}
+
+	if loader.values, err = readConfigFile(file); err != nil {
+		return nil, err
+	}
+
+	if err := validateConfig(flags, loader.values); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	if err := setFlags(flags, loader.values, explicit); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	return loader, nil
+}
+
+func modTime(file string) (time.Time, error) {
+	info, err := os.Stat(file)
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
+
+// value returns the raw values of a flag: the explicit values, the values in
+// the configuration file or the default values.
+func (l *configLoader) value(values configValues, name string) []string {
+	if v, found := l.explicit[name]; found {
+		return v
+	}
+
+	if v, found := values[name]; found {
+		return v
+	}
+
+	return l.flags[name].Default
+}
+
+// Config returns the settings of the reloadable flags as they were loaded
+// last.
+func (l *configLoader) Config() (reloadableConfig, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return newReloadableConfig(func(name string) []string { return l.value(l.values, name) })
+}
+
+// Reload reads the configuration file again and returns the new settings of
+// the reloadable flags. Changes to other flags are logged, because they are
+// only applied when the proxy restarts.
+func (l *configLoader) Reload() (reloadableConfig, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	fileModTime, err := modTime(l.file)
+
+	if err != nil {
+		return reloadableConfig{}, err
+	}
+
+	values, err := readConfigFile(l.file)
+
+	if err != nil {
+		return reloadableConfig{}, err
+	}
+
+	if err := validateConfig(l.flags, values); err != nil {
+		return reloadableConfig{}, fmt.Errorf("%s: %s", l.file, err)
+	}
+
+	cfg, err := newReloadableConfig(func(name string) []string { return l.value(values, name) })
+
+	if err != nil {
+		return reloadableConfig{}, fmt.Errorf("%s: %s", l.file, err)
+	}
+
+	for name := range l.flags {
+		if reloadableFlags[name] {
+			continue
+		}
+
+		if strings.Join(l.value(values, name), "\n") != strings.Join(l.value(l.values, name), "\n") {
+			log.Warn("Configuration of ", name, " changed, restart the proxy to apply it")
+		}
+	}
+
+	l.values = values
+	l.modTime = fileModTime
+	return cfg, nil
+}
+
+// Changed returns true if the configuration file was modified since it was
+// last loaded.
+func (l *configLoader) Changed() bool {
+	fileModTime, err := modTime(l.file)
+
+	if err != nil {
+		log.Warn("Error checking configuration file ", l.file, ": ", err)
+		return false
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return !fileModTime.Equal(l.modTime)
+}
+
+// Watch reloads the configuration file on SIGHUP and when the file changes,
+// which is checked every interval, and calls apply with the new settings. The
+// current settings are kept if the file is not valid.
+func (l *configLoader) Watch(interval time.Duration, apply func(reloadableConfig)) {
+	if len(l.file) == 0 {
+		return
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+
+	if interval > 0 {
+		tick = time.Tick(interval)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-hangup:
+			case <-tick:
+				if !l.Changed() {
+					continue
+				}
+			}
+
+			log.Info("Reloading configuration from ", l.file)
+			cfg, err := l.Reload()
+
+			if err != nil {
+				log.Error("Error reloading configuration, keeping the current configuration: ", err)
+				continue
+			}
+
+			apply(cfg)
+		}
+	}()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfigFile(t *testing.T, dir, content string) string {
+	path := filepath.Join(dir, "config.json")
+
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestReadConfigFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "config")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	values, err := readConfigFile(writeConfigFile(t, dir, `{
+		"default-iam-role": "arn:aws:iam::123456789012:role/default",
+		"metadata-max-attempts": 5,
+		"share-credentials": true,
+		"allowed-role": ["arn:aws:iam::123456789012:role/a", "arn:aws:iam::123456789012:role/b"],
+		"metadata-cache-ttl": {"placement/*": "1h", "instance-id": "0"}
+	}`))
+	assert.Nil(err)
+	assert.Equal([]string{"arn:aws:iam::123456789012:role/default"}, values["default-iam-role"])
+	assert.Equal([]string{"5"}, values["metadata-max-attempts"])
+	assert.Equal([]string{"true"}, values["share-credentials"])
+	assert.Equal([]string{"arn:aws:iam::123456789012:role/a", "arn:aws:iam::123456789012:role/b"}, values["allowed-role"])
+	assert.Equal([]string{"instance-id=0", "placement/*=1h"}, values["metadata-cache-ttl"])
+
+	_, err = readConfigFile(writeConfigFile(t, dir, `{"allowed-role": [{"a": 1}]}`))
+	assert.NotNil(err)
+
+	_, err = readConfigFile(writeConfigFile(t, dir, `{"server": null}`))
+	assert.NotNil(err)
+}
+
+func TestConfigLoader(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "config")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	app := kingpin.New("ec2metaproxy", "")
+	role := roleArnOpt(app.Flag("default-iam-role", ""))
+	policy := app.Flag("default-iam-policy", "").Default("").String()
+	allowed := app.Flag("allowed-role", "").Strings()
+	behavior := app.Flag("no-role-behavior", "").Default("none").Enum("none", "instance-profile")
+	app.Flag("allow-instance-profile", "").Bool()
+	app.Flag("share-credentials", "").Bool()
+	duration := app.Flag("session-duration", "").Default("1h").Duration()
+	app.Flag("metadata-overrides-file", "").Default("").String()
+	app.Flag("metadata-allow", "").Strings()
+	app.Flag("metadata-deny", "").Strings()
+	app.Flag("metadata-denied-status", "").Default("404").Enum("403", "404")
+	app.Flag("container-network-identity", "").Bool()
+	server := app.Flag("server", "").Default(":18000").String()
+	command := app.Command("docker", "")
+	endpoint := command.Flag("docker-endpoint", "").Default(defaultDockerEndpoint).String()
+
+	os.Setenv("EC2METAPROXY_SESSION_DURATION", "30m")
+	defer os.Unsetenv("EC2METAPROXY_SESSION_DURATION")
+
+	path := writeConfigFile(t, dir, `{
+		"default-iam-role": "arn:aws:iam::123456789012:role/file",
+		"default-iam-policy": "{}",
+		"allowed-role": ["arn:aws:iam::123456789012:role/*"],
+		"session-duration": "15m",
+		"docker-endpoint": "tcp://127.0.0.1:2375"
+	}`)
+	args := []string{"--default-iam-policy", "{\"Version\":\"2012-10-17\"}", "docker"}
+	_, err = app.Parse(args)
+	assert.Nil(err)
+
+	loader, err := newConfigLoader(app, args, "docker", path)
+	assert.Nil(err)
+
+	// Command line > environment > configuration file > default
+	assert.Equal("arn:aws:iam::123456789012:role/file", role.String())
+	assert.Equal(`{"Version":"2012-10-17"}`, *policy)
+	assert.Equal([]string{"arn:aws:iam::123456789012:role/*"}, *allowed)
+	assert.Equal("none", *behavior)
+	assert.Equal(30*time.Minute, *duration)
+	assert.Equal(":18000", *server)
+	assert.Equal("tcp://127.0.0.1:2375", *endpoint)
+
+	// Reloaded values are parsed, not set on the flags
+	writeConfigFile(t, dir, `{
+		"no-role-behavior": "instance-profile",
+		"allow-instance-profile": true,
+		"metadata-deny": ["iam/*"],
+		"metadata-denied-status": 403,
+		"server": ":18001"
+	}`)
+	cfg, err := loader.Reload()
+	assert.Nil(err)
+	assert.True(cfg.DefaultIamRole.Empty())
+	assert.Equal(`{"Version":"2012-10-17"}`, cfg.DefaultIamPolicy)
+	assert.Len(cfg.AllowedRoles, 0)
+	assert.Equal(noRoleInstanceProfile, cfg.NoRoleBehavior)
+	assert.True(cfg.AllowInstanceProfile)
+	assert.Equal(30*time.Minute, cfg.SessionDuration)
+	assert.False(cfg.MetadataACL.Allowed("meta-data/iam/info"))
+	assert.Equal(403, cfg.MetadataDeniedStatus)
+	assert.Equal(":18000", *server)
+
+	// Invalid files are rejected
+	writeConfigFile(t, dir, `{"no-role-behavior": "other"}`)
+	_, err = loader.Reload()
+	assert.NotNil(err)
+
+	writeConfigFile(t, dir, `{"unknown-flag": "value"}`)
+	_, err = loader.Reload()
+	assert.NotNil(err)
+
+	_, err = newConfigLoader(app, args, "docker", path)
+	assert.NotNil(err)
+}
+
+func TestConfigureKeepsCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	platform := testContainerService{"172.17.0.2": {ID: "container-a"}}
+	credentials := newTestCredentialsProvider(platform)
+	creds, err := credentials.CredentialsForIP("172.17.0.2")
+	assert.Nil(err)
+
+	newRole, _ := newRoleArn("arn:aws:iam::123456789012:role/new-role")
+	cfg := *credentials.config.Load()
+
+	credentials.config.Store(cfg)
+	reloaded, err := credentials.CredentialsForIP("172.17.0.2")
+	assert.Nil(err)
+	assert.Equal(creds.GeneratedAt, reloaded.GeneratedAt)
+
+	cfg.DefaultIamRole = newRole
+	credentials.config.Store(cfg)
+	reloaded, err = credentials.CredentialsForIP("172.17.0.2")
+	assert.Nil(err)
+	assert.Equal(newRole, reloaded.RoleArn)
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	config := newTestConfig()
+	testConfigure(config, func(cfg *reloadableConfig) {
+		cfg.Flags = configValues{
+			"session-duration": {"1h", "30m"},
+			"allowed-role":     {"arn:aws:iam::123456789012:role/a", "arn:aws:iam::123456789012:role/b"},
+			"default-iam-role": {},
+		}
+	})
+
+	// Reloadable flags have the values of the applied configuration
+	flags := effectiveConfig("docker", config)["flags"].(map[string]string)
+	assert.Equal("30m", flags["session-duration"])
+	assert.Equal("arn:aws:iam::123456789012:role/a,arn:aws:iam::123456789012:role/b", flags["allowed-role"])
+	assert.Equal("", flags["default-iam-role"])
+	assert.Equal(*metadataURL, flags["metadata-url"])
+}
+
+func TestReloadableConfigSessionDuration(t *testing.T) {
+	assert := assert.New(t)
+
+	parse := func(duration string) error {
+		values := configValues{
+			"no-role-behavior":       {noRoleNone},
+			"metadata-denied-status": {"404"},
+			"session-duration":       {duration},
+		}
+
+		_, err := newReloadableConfig(func(name string) []string { return values[name] })
+		return err
+	}
+
+	assert.Nil(parse("15m"))
+	assert.Nil(parse("12h"))
+	assert.NotNil(parse("14m"))
+	assert.NotNil(parse("12h1m"))
+	assert.NotNil(parse("1 hour"))
+}
@@ -1,13 +1,108 @@
 package main
 
+import (
+	"fmt"
+	"strings"
+)
+
 type containerInfo struct {
-	ID        string
-	Name      string
-	IamRole   roleArn
-	IamPolicy string
+	ID     string
+	Name   string
+	Image  string
+	Labels map[string]string
+	// Network identity of the container for the IP the request came from
+	IPAddress  string
+	Hostname   string
+	MacAddress string
+	IamRole    roleArn
+	// Additional roles the container can select by name
+	IamRoles []roleArn
+	// Set instead of IamRole if the container role is a sentinel value
+	NoRoleBehavior string
+	// Roles to assume, in order, before assuming IamRole
+	IamRoleChain  roleChain
+	IamExternalID string
+	IamPolicy     string
+	// Name of a policy in the policy directory to use instead of IamPolicy
+	IamPolicyName string
+	// Name of the credential source that provides credentials for the container
+	CredentialSource string
+	// Name of the Vault AWS secrets engine role for the vault credential source
+	VaultRole string
 }
 
 type containerService interface {
 	ContainerForIP(containerIP string) (containerInfo, error)
+	// Containers returns the known containers, one for each IP, ordered by IP.
+	Containers() []containerInfo
+	// Sync refreshes the known containers from the container manager.
+	Sync()
+	// Synced returns true if the containers were synchronized at least once.
+	Synced() bool
 	TypeName() string
 }
+
+// newContainerInfo reads the container role configuration from the container
+// environment variables or job metadata.
+func newContainerInfo(id, name string, metadata map[string]string) (info containerInfo, err error) {
+	info.ID = id
+	info.Name = name
+
+	switch value := strings.TrimSpace(metadata["IAM_ROLE"]); value {
+	case "":
+	case ":" + noRoleNone:
+		info.NoRoleBehavior = noRoleNone
+	case ":" + noRoleInstanceProfile:
+		info.NoRoleBehavior = noRoleInstanceProfile
+	default:
+		if info.IamRole, err = roleDefaults.Parse(value); err != nil {
+			return
+		}
+	}
+
+	if value := strings.TrimSpace(metadata["IAM_ROLES"]); len(value) > 0 {
+		if len(info.NoRoleBehavior) > 0 {
+			err = fmt.Errorf("IAM_ROLE=:%s can not be combined with IAM_ROLES", info.NoRoleBehavior)
+			return
+		}
+
+		if info.IamRoles, err = newRoleList(value); err != nil {
+			return
+		}
+
+		for _, role := range info.IamRoles {
+			if role.RoleName() == info.IamRole.RoleName() && !role.Equals(info.IamRole) {
+				err = fmt.Errorf("Duplicate role name %s in IAM_ROLE and IAM_ROLES", role.RoleName())
+				return
+			}
+		}
+	}
+
+	if value := strings.TrimSpace(metadata["IAM_ROLE_CHAIN"]); len(value) > 0 {
+		if info.IamRoleChain, err = newRoleChain(value); err != nil {
+			return
+		}
+	}
+
+	info.IamExternalID = strings.TrimSpace(metadata["IAM_EXTERNAL_ID"])
+	info.IamPolicy = strings.TrimSpace(metadata["IAM_POLICY"])
+	info.IamPolicyName = strings.TrimSpace(metadata["IAM_POLICY_NAME"])
+	info.CredentialSource = strings.TrimSpace(metadata["IAM_CREDENTIAL_SOURCE"])
+	info.VaultRole = strings.TrimSpace(metadata["VAULT_AWS_ROLE"])
+	return
+}
+
+// envMap converts a list of KEY=VALUE environment variables to a map.
+func envMap(env []string) map[string]string {
+	result := make(map[string]string)
+
+	for _, e := range env {
+		v := strings.SplitN(e, "=", 2)
+
+		if len(v) > 1 {
+			result[v[0]] = v[1]
+		}
+	}
+
+	return result
+}
@@ -1,18 +1,25 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/sts"
+	log "github.com/cihub/seelog"
 )
 
 const (
 	maxSessionNameLen int = 32
+
+	// Behaviors for containers that do not have a role
+	noRoleNone            = "none"
+	noRoleInstanceProfile = "instance-profile"
 )
 
 var (
@@ -20,6 +27,23 @@ var (
 	invalidSessionNameRegexp = regexp.MustCompile(`[^\w+=,.@-]`)
 
 	sessionExpiration = 5 * time.Minute
+
+	// Limits of the role session duration. Sessions of roles that are assumed
+	// with the credentials of another role are limited to 1 hour by STS.
+	minSessionDuration        = 15 * time.Minute
+	maxSessionDuration        = 12 * time.Hour
+	maxChainedSessionDuration = time.Hour
+
+	// Returned by CredentialsForIP if the container has no credentials, like an
+	// instance without an instance profile
+	errNoCredentials = errors.New("Container has no role")
+
+	// Returned by CredentialsForIP if the container uses the credentials of the
+	// instance profile
+	errInstanceProfile = errors.New("Container uses the instance profile")
+
+	// Returned by CredentialsForRole if the container can not use the role
+	errUnknownRole = errors.New("Unknown role")
 )
 
 type credentials struct {
@@ -43,102 +67,639 @@ func (c credentials) ExpiresIn(d time.Duration) bool {
 	return c.ExpiredAt(time.Now().Add(d))
 }
 
+// credentialsRequest describes the credentials required by a container.
+type credentialsRequest struct {
+	Container containerInfo
+	Platform  string
+	// Roles to assume, in order, before assuming Role
+	RoleChain   roleChain
+	Role        roleChainLink
+	IamPolicy   string
+	SessionName string
+	Duration    time.Duration
+}
+
+// credentialSource generates credentials for containers.
+type credentialSource interface {
+	Credentials(req credentialsRequest) (credentials, error)
+}
+
 type containerCredentials struct {
 	containerInfo
 	credentials
+	iamPolicy string
+	// Key of the shared credentials the credentials were copied from, or nil
+	// if they are not shared
+	sharedKey *credentialsKey
+}
+
+// IsValid returns true if the credentials can be used by the container and do not
+// need to be renewed yet.
+func (c containerCredentials) IsValid(container containerInfo, iamPolicy string) bool {
+	return c.IsCurrent(container, iamPolicy) && !c.credentials.ExpiresIn(sessionExpiration)
 }
 
-func (c containerCredentials) IsValid(container containerInfo) bool {
+// IsCurrent returns true if the credentials can be used by the container until
+// they expire.
+func (c containerCredentials) IsCurrent(container containerInfo, iamPolicy string) bool {
 	return c.containerInfo.IamRole.Equals(container.IamRole) &&
+		c.containerInfo.IamExternalID == container.IamExternalID &&
+		c.containerInfo.IamRoleChain.Equals(container.IamRoleChain) &&
+		c.containerInfo.CredentialSource == container.CredentialSource &&
 		c.containerInfo.ID == container.ID &&
-		!c.credentials.ExpiresIn(sessionExpiration)
+		c.iamPolicy == iamPolicy &&
+		!c.credentials.ExpiredNow()
+}
+
+// credentialsKey identifies credentials that can be shared by all containers
+// that resolve to the same role and policy. The proxy does not send session
+// tags or policy ARNs, so they are not part of the key.
+type credentialsKey struct {
+	source    string
+	roleChain string
+	role      string
+	iamPolicy string
+	duration  time.Duration
+}
+
+func (k credentialsKey) SessionName(platform string) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%s", k.source, k.roleChain, k.role, k.iamPolicy, k.duration)))
+	return generateSessionName(platform, "shared-"+hex.EncodeToString(hash[:]))
 }
 
+// credentialsProvider gets credentials for containers. The default role, the
+// allowed roles and the other reloadable settings come from the applied
+// configuration. When the configuration is reloaded, cached credentials are
+// kept and are used for as long as they match the role and policy of the
+// container.
 type credentialsProvider struct {
 	container            containerService
-	awsSts               *sts.STS
-	defaultIamRoleArn    roleArn
-	defaultIamPolicy     string
+	sources              map[string]credentialSource
+	defaultSource        string
+	config               *liveConfig
+	policies             *policyStore
 	containerCredentials map[string]containerCredentials
-	lock                 sync.Mutex
+	sharedCredentials    map[credentialsKey]credentials
+	// Requests to credential sources that are in progress, by container
+	// credentials key or shared credentials key
+	pending map[interface{}]*credentialsCall
+	// Containers and roles that were logged as not allowed
+	disallowedWarned map[string]bool
+	lock             sync.Mutex
+}
+
+// credentialsCall is a request to a credential source that is in progress.
+type credentialsCall struct {
+	done        sync.WaitGroup
+	credentials credentials
+	err         error
 }
 
-func newCredentialsProvider(awsSession *session.Session, container containerService, defaultIamRoleArn roleArn, defaultIamPolicy string) *credentialsProvider {
+func newCredentialsProvider(container containerService, sources map[string]credentialSource, defaultSource string, config *liveConfig, policies *policyStore) *credentialsProvider {
 	return &credentialsProvider{
 		container:            container,
-		awsSts:               sts.New(awsSession),
-		defaultIamRoleArn:    defaultIamRoleArn,
-		defaultIamPolicy:     defaultIamPolicy,
+		sources:              sources,
+		defaultSource:        defaultSource,
+		config:               config,
+		policies:             policies,
 		containerCredentials: make(map[string]containerCredentials),
+		sharedCredentials:    make(map[credentialsKey]credentials),
+		pending:              make(map[interface{}]*credentialsCall),
+		disallowedWarned:     make(map[string]bool),
 	}
 }
 
+// CredentialsForIP returns the credentials of the primary role of the
+// container.
 func (c *credentialsProvider) CredentialsForIP(containerIP string) (credentials, error) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
+	cfg := c.config.Load()
+	container, roles, iamPolicy, err := c.containerRoles(cfg, containerIP)
 
-	container, err := c.container.ContainerForIP(containerIP)
+	if err != nil {
+		return credentials{}, err
+	}
+
+	return c.credentialsForRole(cfg, containerIP, container, roles[0], iamPolicy)
+}
+
+// RoleNamesForIP returns the names of the roles the container can use. The
+// primary role is first.
+func (c *credentialsProvider) RoleNamesForIP(containerIP string) ([]string, error) {
+	_, roles, _, err := c.containerRoles(c.config.Load(), containerIP)
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(roles))
+
+	for i, role := range roles {
+		names[i] = role.RoleName()
+	}
+
+	return names, nil
+}
+
+// CredentialsForRole returns the credentials of the container role with the
+// given name. Credentials are cached separately for each role.
+func (c *credentialsProvider) CredentialsForRole(containerIP, roleName string) (credentials, error) {
+	cfg := c.config.Load()
+	container, roles, iamPolicy, err := c.containerRoles(cfg, containerIP)
 
 	if err != nil {
 		return credentials{}, err
 	}
 
-	oldCredentials, found := c.containerCredentials[containerIP]
+	for _, role := range roles {
+		if role.RoleName() == roleName {
+			return c.credentialsForRole(cfg, containerIP, container, role, iamPolicy)
+		}
+	}
+
+	return credentials{}, errUnknownRole
+}
+
+// containerRoles returns the container for the IP and the roles it is allowed
+// to use, starting with the primary role.
+func (c *credentialsProvider) containerRoles(cfg *reloadableConfig, containerIP string) (containerInfo, []roleArn, string, error) {
+	container, err := c.container.ContainerForIP(containerIP)
+
+	if err != nil {
+		return container, nil, "", err
+	}
+
+	roles, iamPolicy, err := c.allowedRoles(cfg, container)
+	return container, roles, iamPolicy, err
+}
+
+// ContainerRoles returns the roles the container is allowed to use, starting
+// with the primary role, and the policy applied to the role sessions.
+func (c *credentialsProvider) ContainerRoles(container containerInfo) ([]roleArn, string, error) {
+	return c.allowedRoles(c.config.Load(), container)
+}
+
+// allowedRoles returns the roles of the container that are allowed and logs
+// the roles that are not.
+func (c *credentialsProvider) allowedRoles(cfg *reloadableConfig, container containerInfo) ([]roleArn, string, error) {
+	decisions, iamPolicy, err := c.rolesForContainer(cfg, container)
 
-	if !found || !oldCredentials.IsValid(container) {
-		roleArn := container.IamRole
-		iamPolicy := container.IamPolicy
+	var roles []roleArn
 
-		if roleArn.Empty() {
-			roleArn = c.defaultIamRoleArn
+	for _, decision := range decisions {
+		if decision.Allowed {
+			roles = append(roles, decision.Role)
+		} else {
+			c.warnDisallowed(container, decision)
+		}
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return roles, iamPolicy, nil
+}
 
-			if len(iamPolicy) == 0 {
-				iamPolicy = c.defaultIamPolicy
+// roleDecision is whether a role of a container may be used and why.
+type roleDecision struct {
+	Role    roleArn
+	Primary bool
+	Allowed bool
+	Reason  string
+}
+
+// rolesForContainer decides for each role of the container, starting with the
+// primary role, whether it may be used. It returns an error with the decisions
+// if no role is allowed.
+func (c *credentialsProvider) rolesForContainer(cfg *reloadableConfig, container containerInfo) ([]roleDecision, string, error) {
+	switch roleBehavior(cfg, container) {
+	case noRoleNone:
+		return nil, "", errNoCredentials
+	case noRoleInstanceProfile:
+		return nil, "", errInstanceProfile
+	}
+
+	primary, iamPolicy, err := c.resolveRole(cfg, container)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	candidates := []roleArn{primary}
+
+	for _, role := range container.IamRoles {
+		if !role.Equals(primary) {
+			candidates = append(candidates, role)
+		}
+	}
+
+	// Every role in the chain is assumed with the credentials of the container,
+	// so a role that is not allowed in the chain denies all roles
+	deniedLink := ""
+
+	for _, link := range container.IamRoleChain {
+		if !link.RoleArn.Equals(cfg.DefaultIamRole) && !cfg.AllowedRoles.Allowed(link.RoleArn) {
+			deniedLink = link.RoleArn.String()
+			break
+		}
+	}
+
+	var decisions []roleDecision
+	allowed := false
+
+	for i, role := range candidates {
+		decision := roleDecision{Role: role, Primary: i == 0, Allowed: true, Reason: "allowed"}
+
+		if len(deniedLink) > 0 {
+			decision.Allowed, decision.Reason = false, "role chain link "+deniedLink+" denied by --allowed-role"
+		} else if role.Equals(cfg.DefaultIamRole) {
+			// The default role is configured by the operator and always allowed
+			decision.Reason = "allowed (default role)"
+		} else if !cfg.AllowedRoles.Allowed(role) {
+			decision.Allowed, decision.Reason = false, "denied by --allowed-role"
+		}
+
+		allowed = allowed || decision.Allowed
+		decisions = append(decisions, decision)
+	}
+
+	if !allowed {
+		return decisions, iamPolicy, fmt.Errorf("No role of container %s is allowed", container.ID)
+	}
+
+	return decisions, iamPolicy, nil
+}
+
+// warnDisallowed logs that the role is not allowed for the container, once
+// for each container and role.
+func (c *credentialsProvider) warnDisallowed(container containerInfo, decision roleDecision) {
+	key := container.ID + "\x00" + decision.Role.String()
+
+	c.lock.Lock()
+	warned := c.disallowedWarned[key]
+	c.lock.Unlock()
+
+	if warned {
+		return
+	}
+
+	// The container service takes its own lock, so the running containers are
+	// listed before taking the lock
+	running := make(map[string]bool)
+
+	for _, info := range c.container.Containers() {
+		running[info.ID] = true
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.disallowedWarned[key] {
+		return
+	}
+
+	// Forget the containers that are gone
+	for warned := range c.disallowedWarned {
+		if !running[strings.SplitN(warned, "\x00", 2)[0]] {
+			delete(c.disallowedWarned, warned)
+		}
+	}
+
+	c.disallowedWarned[key] = true
+	log.Warn("Role ", decision.Role, " is not allowed for container ", container.ID, ": ", decision.Reason)
+}
+
+// credentialsForRole returns cached credentials for the container role or
+// gets new credentials.
+func (c *credentialsProvider) credentialsForRole(cfg *reloadableConfig, containerIP string, container containerInfo, roleArn roleArn, iamPolicy string) (credentials, error) {
+	key := containerIP + "\x00" + roleArn.String()
+
+	c.lock.Lock()
+	oldCredentials, found := c.containerCredentials[key]
+	c.lock.Unlock()
+
+	if found && oldCredentials.IsValid(container, iamPolicy) {
+		return oldCredentials.credentials, nil
+	}
+
+	var sharedKey *credentialsKey
+
+	if c.sharesCredentials(cfg, container) {
+		shared := c.sharedCredentialsKey(cfg, container, roleArn, iamPolicy)
+		sharedKey = &shared
+	}
+
+	return c.singleCall(key, func() (credentials, error) {
+		role, err := c.credentialsForContainer(cfg, container, roleArn, iamPolicy)
+
+		if err != nil {
+			if found && oldCredentials.IsCurrent(container, iamPolicy) {
+				log.Warnf("Error renewing credentials for container %s, using existing credentials that expire at %s: %s", container.ID, oldCredentials.Expiration, err)
+				return oldCredentials.credentials, nil
 			}
+
+			return credentials{}, err
 		}
 
-		role, err := c.AssumeRole(roleArn, iamPolicy, generateSessionName(c.container.TypeName(), container.ID))
+		c.lock.Lock()
+		c.containerCredentials[key] = containerCredentials{container, role, iamPolicy, sharedKey}
+		c.lock.Unlock()
+		return role, nil
+	})
+}
+
+// singleCall calls fetch, unless a call with the same key is in progress, in
+// which case it waits for that call and returns its result. fetch is called
+// without holding the lock, so that slow or retried requests for one role do
+// not block the requests for other roles.
+func (c *credentialsProvider) singleCall(key interface{}, fetch func() (credentials, error)) (credentials, error) {
+	c.lock.Lock()
+
+	if call, found := c.pending[key]; found {
+		c.lock.Unlock()
+		call.done.Wait()
+		return call.credentials, call.err
+	}
+
+	call := &credentialsCall{}
+	call.done.Add(1)
+	c.pending[key] = call
+	c.lock.Unlock()
+
+	call.credentials, call.err = fetch()
+
+	c.lock.Lock()
+	delete(c.pending, key)
+	c.lock.Unlock()
+	call.done.Done()
+
+	return call.credentials, call.err
+}
+
+func (c *credentialsProvider) sharedCredentialsKey(cfg *reloadableConfig, container containerInfo, roleArn roleArn, iamPolicy string) credentialsKey {
+	sourceName := container.CredentialSource
+
+	if len(sourceName) == 0 {
+		sourceName = c.defaultSource
+	}
+
+	role := roleChainLink{roleArn, container.IamExternalID}
+	return credentialsKey{sourceName, container.IamRoleChain.String(), role.String(), iamPolicy, containerSessionDuration(cfg, container)}
+}
+
+// credentialsRequest returns the request for the credentials of a role of the
+// container, before the session name of shared credentials is set.
+func (c *credentialsProvider) credentialsRequest(cfg *reloadableConfig, container containerInfo, roleArn roleArn, iamPolicy string) credentialsRequest {
+	return credentialsRequest{
+		Container:   container,
+		Platform:    c.container.TypeName(),
+		RoleChain:   container.IamRoleChain,
+		Role:        roleChainLink{roleArn, container.IamExternalID},
+		IamPolicy:   iamPolicy,
+		SessionName: generateSessionName(c.container.TypeName(), container.ID),
+		Duration:    containerSessionDuration(cfg, container),
+	}
+}
+
+// containerSessionDuration returns the duration of the role sessions of the container.
+func containerSessionDuration(cfg *reloadableConfig, container containerInfo) time.Duration {
+	if len(container.IamRoleChain) > 0 && cfg.SessionDuration > maxChainedSessionDuration {
+		return maxChainedSessionDuration
+	}
+
+	return cfg.SessionDuration
+}
+
+// credentialsForContainer gets credentials for a single container from the
+// container's credential source. If credentials are shared, new credentials
+// are only requested once the credentials shared by all containers with the
+// same role and policy expire.
+func (c *credentialsProvider) credentialsForContainer(cfg *reloadableConfig, container containerInfo, roleArn roleArn, iamPolicy string) (credentials, error) {
+	sourceName := container.CredentialSource
+
+	if len(sourceName) == 0 {
+		sourceName = c.defaultSource
+	}
+
+	source, found := c.sources[sourceName]
+
+	if !found {
+		return credentials{}, fmt.Errorf("Credential source %s is not configured", sourceName)
+	}
+
+	req := c.credentialsRequest(cfg, container, roleArn, iamPolicy)
+
+	if !c.sharesCredentials(cfg, container) {
+		return source.Credentials(req)
+	}
+
+	key := c.sharedCredentialsKey(cfg, container, roleArn, iamPolicy)
+
+	c.lock.Lock()
+	shared, found := c.sharedCredentials[key]
+	c.lock.Unlock()
+
+	if found && !shared.ExpiresIn(sessionExpiration) {
+		return shared, nil
+	}
+
+	return c.singleCall(key, func() (credentials, error) {
+		req.SessionName = key.SessionName(c.container.TypeName())
+		role, err := source.Credentials(req)
 
 		if err != nil {
+			if found && !shared.ExpiredNow() {
+				log.Warnf("Error renewing shared credentials for role %s, using existing credentials that expire at %s: %s", roleArn, shared.Expiration, err)
+				return shared, nil
+			}
+
 			return credentials{}, err
 		}
 
-		oldCredentials = containerCredentials{container, role}
-		c.containerCredentials[containerIP] = oldCredentials
+		c.lock.Lock()
+		c.sharedCredentials[key] = role
+		c.lock.Unlock()
+		return role, nil
+	})
+}
+
+// credentialsStatus describes cached credentials without the secrets.
+type credentialsStatus struct {
+	RoleArn     string    `json:"role_arn"`
+	PolicyHash  string    `json:"policy_hash,omitempty"`
+	GeneratedAt time.Time `json:"generated_at"`
+	Expiration  time.Time `json:"expiration"`
+}
+
+// CachedCredentials returns the status of the cached credentials of the
+// container IP, ordered by role ARN.
+func (c *credentialsProvider) CachedCredentials(containerIP string) []credentialsStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var result []credentialsStatus
+
+	for key, cached := range c.containerCredentials {
+		if strings.HasPrefix(key, containerIP+"\x00") {
+			result = append(result, credentialsStatus{
+				RoleArn:     cached.RoleArn.String(),
+				PolicyHash:  policyHash(cached.iamPolicy),
+				GeneratedAt: cached.GeneratedAt,
+				Expiration:  cached.Expiration,
+			})
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].RoleArn < result[j].RoleArn })
+	return result
+}
+
+// Evict removes the cached credentials of the container IP, including the
+// shared credentials they were copied from, so the next request gets new
+// credentials. Returns the number of credentials removed.
+func (c *credentialsProvider) Evict(containerIP string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	count := 0
+
+	for key, cached := range c.containerCredentials {
+		if strings.HasPrefix(key, containerIP+"\x00") {
+			delete(c.containerCredentials, key)
+
+			// The key the credentials were stored with, which differs from
+			// the current key if the configuration was reloaded since
+			if cached.sharedKey != nil {
+				delete(c.sharedCredentials, *cached.sharedKey)
+			}
+
+			count++
+		}
+	}
+
+	return count
+}
+
+// policyHash returns a short hash that identifies a policy without showing it.
+func policyHash(policy string) string {
+	if len(policy) == 0 {
+		return ""
 	}
 
-	return oldCredentials.credentials, nil
+	hash := sha256.Sum256([]byte(policy))
+	return hex.EncodeToString(hash[:8])
+}
+
+// RoleBehavior returns the behavior for a container that does not have a role
+// (none or instance-profile), or an empty string if a role is assumed for the
+// container. The role sentinel of the container takes precedence over the
+// override rules, which take precedence over the default role and the global
+// behavior.
+func (c *credentialsProvider) RoleBehavior(container containerInfo) string {
+	return roleBehavior(c.config.Load(), container)
 }
 
-func (c *credentialsProvider) AssumeRole(roleArn roleArn, iamPolicy, sessionName string) (credentials, error) {
-	var policy *string
+func roleBehavior(cfg *reloadableConfig, container containerInfo) string {
+	if !container.IamRole.Empty() || len(container.IamRoles) > 0 {
+		return ""
+	}
+
+	behavior := container.NoRoleBehavior
+
+	if len(behavior) == 0 && cfg.Overrides != nil {
+		behavior = cfg.Overrides.NoRoleBehavior(container)
+	}
+
+	if len(behavior) == 0 {
+		if !cfg.DefaultIamRole.Empty() {
+			return ""
+		}
+
+		behavior = cfg.NoRoleBehavior
+	}
 
-	if len(iamPolicy) > 0 {
-		policy = aws.String(iamPolicy)
+	if behavior == noRoleInstanceProfile && !cfg.AllowInstanceProfile {
+		log.Warn("Container ", container.ID, " requested the instance profile, but the instance profile is not allowed")
+		return noRoleNone
 	}
 
-	resp, err := c.awsSts.AssumeRole(&sts.AssumeRoleInput{
-		DurationSeconds: aws.Int64(3600), // Max is 1 hour
-		Policy:          policy,
-		RoleArn:         aws.String(roleArn.String()),
-		RoleSessionName: aws.String(sessionName),
+	return behavior
+}
+
+func (c *credentialsProvider) resolveRole(cfg *reloadableConfig, container containerInfo) (roleArn, string, error) {
+	roleArn := container.IamRole
+	iamPolicy := container.IamPolicy
+
+	if len(container.IamPolicyName) > 0 {
+		if len(iamPolicy) > 0 {
+			return roleArn, "", fmt.Errorf("Container %s sets both IAM_POLICY and IAM_POLICY_NAME", container.ID)
+		}
+
+		policy, err := c.policies.Policy(container.IamPolicyName)
+
+		if err != nil {
+			return roleArn, "", err
+		}
+
+		iamPolicy = policy
+	}
+
+	if roleArn.Empty() && len(container.IamRoles) > 0 {
+		roleArn = container.IamRoles[0]
+	} else if roleArn.Empty() {
+		roleArn = cfg.DefaultIamRole
+
+		if len(iamPolicy) == 0 && c.supportsIamPolicy(container) {
+			iamPolicy = cfg.DefaultIamPolicy
+		}
+	}
+
+	return roleArn, iamPolicy, nil
+}
+
+// supportsIamPolicy returns false if the credential source of the container
+// can not restrict the credentials with an IAM policy.
+func (c *credentialsProvider) supportsIamPolicy(container containerInfo) bool {
+	sourceName := container.CredentialSource
+
+	if len(sourceName) == 0 {
+		sourceName = c.defaultSource
+	}
+
+	source, ok := c.sources[sourceName].(interface {
+		SupportsIamPolicy() bool
 	})
 
-	if err != nil {
-		return credentials{}, err
+	return !ok || source.SupportsIamPolicy()
+}
+
+// sharesCredentials returns true if the credentials of the container are shared
+// with other containers. Sources that authenticate each container, such as
+// webidentity, never share credentials.
+func (c *credentialsProvider) sharesCredentials(cfg *reloadableConfig, container containerInfo) bool {
+	if !cfg.ShareCredentials {
+		return false
 	}
 
-	return credentials{
-		AccessKey:   *resp.Credentials.AccessKeyId,
-		SecretKey:   *resp.Credentials.SecretAccessKey,
-		Token:       *resp.Credentials.SessionToken,
-		Expiration:  *resp.Credentials.Expiration,
-		GeneratedAt: time.Now(),
-		RoleArn:     roleArn,
-	}, nil
+	sourceName := container.CredentialSource
+
+	if len(sourceName) == 0 {
+		sourceName = c.defaultSource
+	}
+
+	source, ok := c.sources[sourceName].(interface {
+		SharesCredentials() bool
+	})
+
+	return !ok || source.SharesCredentials()
 }
 
 func generateSessionName(platform, containerID string) string {
-	sessionName := fmt.Sprintf("%s-%s", platform, containerID)
-	return invalidSessionNameRegexp.ReplaceAllString(sessionName, "_")[0:maxSessionNameLen]
+	sessionName := invalidSessionNameRegexp.ReplaceAllString(fmt.Sprintf("%s-%s", platform, containerID), "_")
+
+	if len(sessionName) > maxSessionNameLen {
+		sessionName = sessionName[0:maxSessionNameLen]
+	}
+
+	return sessionName
 }
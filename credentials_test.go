@@ -0,0 +1,273 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCredentialsRoleBehavior(t *testing.T) {
+	assert := assert.New(t)
+
+	role, _ := newRoleArn("arn:aws:iam::123456789012:role/test-role-name")
+	noneInfo, err := newContainerInfo("a", "a", map[string]string{"IAM_ROLE": ":none"})
+	assert.Nil(err)
+	instanceProfileInfo, err := newContainerInfo("b", "b", map[string]string{"IAM_ROLE": ":instance-profile"})
+	assert.Nil(err)
+
+	platform := testContainerService{
+		"172.17.0.2": noneInfo,
+		"172.17.0.3": instanceProfileInfo,
+		"172.17.0.4": {ID: "c"},
+		"172.17.0.5": {ID: "d", Labels: map[string]string{"passthrough": "true"}},
+		"172.17.0.6": {ID: "e", IamRole: role},
+	}
+	config := newTestConfig()
+	testConfigure(config, func(cfg *reloadableConfig) {
+		cfg.Overrides = &metadataOverrides{rules: []metadataOverrideRule{
+			{Labels: map[string]string{"passthrough": "true"}, NoRoleBehavior: noRoleInstanceProfile},
+		}}
+	})
+	provider := newCredentialsProvider(platform, nil, "sts", config, nil)
+
+	behavior := func(ip string) string {
+		return provider.RoleBehavior(platform[ip])
+	}
+
+	// The instance profile must be allowed
+	assert.Equal(noRoleNone, behavior("172.17.0.3"))
+	testConfigure(config, func(cfg *reloadableConfig) { cfg.AllowInstanceProfile = true })
+
+	assert.Equal(noRoleNone, behavior("172.17.0.2"))
+	assert.Equal(noRoleInstanceProfile, behavior("172.17.0.3"))
+	assert.Equal(noRoleNone, behavior("172.17.0.4"))
+	assert.Equal(noRoleInstanceProfile, behavior("172.17.0.5"))
+	assert.Equal("", behavior("172.17.0.6"))
+
+	testConfigure(config, func(cfg *reloadableConfig) { cfg.NoRoleBehavior = noRoleInstanceProfile })
+	assert.Equal(noRoleInstanceProfile, behavior("172.17.0.4"))
+
+	// The default role applies unless the container or a rule chooses a behavior
+	testConfigure(config, func(cfg *reloadableConfig) { cfg.DefaultIamRole = role })
+	assert.Equal("", behavior("172.17.0.4"))
+	assert.Equal(noRoleNone, behavior("172.17.0.2"))
+	assert.Equal(noRoleInstanceProfile, behavior("172.17.0.5"))
+
+	_, err = provider.CredentialsForIP("172.17.0.2")
+	assert.Equal(errNoCredentials, err)
+	_, err = provider.CredentialsForIP("172.17.0.3")
+	assert.Equal(errInstanceProfile, err)
+}
+
+func TestCredentialsMultipleRoles(t *testing.T) {
+	assert := assert.New(t)
+
+	info, err := newContainerInfo("a", "a", map[string]string{
+		"IAM_ROLE":  "arn:aws:iam::123456789012:role/app-reader",
+		"IAM_ROLES": "arn:aws:iam::123456789012:role/app-writer, arn:aws:iam::123456789012:role/admin",
+	})
+	assert.Nil(err)
+
+	platform := testContainerService{"172.17.0.2": info}
+	sources := map[string]credentialSource{"static": newStaticCredentialSource("AKID", "SECRET", "TOKEN")}
+	config := newTestConfig()
+	provider := newCredentialsProvider(platform, sources, "static", config, nil)
+
+	names, err := provider.RoleNamesForIP("172.17.0.2")
+	assert.Nil(err)
+	assert.Equal([]string{"app-reader", "app-writer", "admin"}, names)
+
+	testConfigure(config, func(cfg *reloadableConfig) { cfg.AllowedRoles = rolePatterns{"arn:aws:iam::123456789012:role/app-*"} })
+	names, err = provider.RoleNamesForIP("172.17.0.2")
+	assert.Nil(err)
+	assert.Equal([]string{"app-reader", "app-writer"}, names)
+
+	creds, err := provider.CredentialsForRole("172.17.0.2", "app-writer")
+	assert.Nil(err)
+	assert.Equal("arn:aws:iam::123456789012:role/app-writer", creds.RoleArn.String())
+
+	creds, err = provider.CredentialsForIP("172.17.0.2")
+	assert.Nil(err)
+	assert.Equal("arn:aws:iam::123456789012:role/app-reader", creds.RoleArn.String())
+
+	_, err = provider.CredentialsForRole("172.17.0.2", "admin")
+	assert.Equal(errUnknownRole, err)
+
+	// The disallowed role is logged once for the container
+	assert.Equal(map[string]bool{"a\x00arn:aws:iam::123456789012:role/admin": true}, provider.disallowedWarned)
+
+	delete(platform, "172.17.0.2")
+	provider.warnDisallowed(containerInfo{ID: "b"}, roleDecision{Role: info.IamRole, Reason: "denied by --allowed-role"})
+	assert.Len(provider.disallowedWarned, 1)
+
+	// Role names must be unique
+	_, err = newContainerInfo("b", "b", map[string]string{
+		"IAM_ROLES": "arn:aws:iam::123456789012:role/app arn:aws:iam::210987654321:role/app",
+	})
+	assert.NotNil(err)
+
+	// A container without a role can not have additional roles
+	_, err = newContainerInfo("c", "c", map[string]string{
+		"IAM_ROLE":  ":none",
+		"IAM_ROLES": "arn:aws:iam::123456789012:role/app",
+	})
+	assert.EqualError(err, "IAM_ROLE=:none can not be combined with IAM_ROLES")
+}
+
+func TestCredentialsAllowedRoleChain(t *testing.T) {
+	assert := assert.New(t)
+
+	info, err := newContainerInfo("a", "a", map[string]string{
+		"IAM_ROLE":       "arn:aws:iam::123456789012:role/app-reader",
+		"IAM_ROLE_CHAIN": "arn:aws:iam::123456789012:role/app-hub arn:aws:iam::123456789012:role/admin",
+	})
+	assert.Nil(err)
+
+	platform := testContainerService{"172.17.0.2": info}
+	sources := map[string]credentialSource{"static": newStaticCredentialSource("AKID", "SECRET", "TOKEN")}
+	config := newTestConfig()
+	testConfigure(config, func(cfg *reloadableConfig) { cfg.AllowedRoles = rolePatterns{"arn:aws:iam::123456789012:role/app-*"} })
+	provider := newCredentialsProvider(platform, sources, "static", config, nil)
+
+	// A role in the chain that is not allowed denies the roles of the container
+	_, err = provider.RoleNamesForIP("172.17.0.2")
+	assert.EqualError(err, "No role of container a is allowed")
+
+	_, err = provider.CredentialsForIP("172.17.0.2")
+	assert.NotNil(err)
+
+	decisions, _, _ := provider.rolesForContainer(config.Load(), info)
+	assert.Len(decisions, 1)
+	assert.Equal("role chain link arn:aws:iam::123456789012:role/admin denied by --allowed-role", decisions[0].Reason)
+
+	// The default role is allowed in the chain
+	testConfigure(config, func(cfg *reloadableConfig) {
+		cfg.DefaultIamRole, _ = newRoleArn("arn:aws:iam::123456789012:role/admin")
+	})
+	names, err := provider.RoleNamesForIP("172.17.0.2")
+	assert.Nil(err)
+	assert.Equal([]string{"app-reader"}, names)
+}
+
+// recordingCredentialSource returns static credentials and records the
+// requests.
+type recordingCredentialSource struct {
+	requests []credentialsRequest
+}
+
+func (s *recordingCredentialSource) Credentials(req credentialsRequest) (credentials, error) {
+	s.requests = append(s.requests, req)
+	return newStaticCredentialSource("AKID", "SECRET", "TOKEN").Credentials(req)
+}
+
+func TestSharedCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	role, _ := newRoleArn("arn:aws:iam::123456789012:role/app")
+	chain, _ := newRoleChain("arn:aws:iam::123456789012:role/hub")
+	platform := testContainerService{
+		"172.17.0.2": {ID: "a", IamRole: role},
+		"172.17.0.3": {ID: "b", IamRole: role},
+		"172.17.0.4": {ID: "c", IamRole: role, IamPolicy: `{"Statement":[]}`},
+		"172.17.0.5": {ID: "d", IamRole: role, CredentialSource: "other"},
+		"172.17.0.6": {ID: "e", IamRole: role, IamRoleChain: chain},
+	}
+	source := &recordingCredentialSource{}
+	other := &recordingCredentialSource{}
+	config := newTestConfig()
+	testConfigure(config, func(cfg *reloadableConfig) {
+		cfg.ShareCredentials = true
+		cfg.SessionDuration = 2 * time.Hour
+	})
+	provider := newCredentialsProvider(platform, map[string]credentialSource{"static": source, "other": other}, "static", config, nil)
+
+	for _, ip := range []string{"172.17.0.2", "172.17.0.3", "172.17.0.4", "172.17.0.5", "172.17.0.6"} {
+		_, err := provider.CredentialsForIP(ip)
+		assert.Nil(err)
+	}
+
+	// Containers with the same role share one session
+	assert.Len(source.requests, 3)
+	assert.Len(other.requests, 1)
+	assert.Equal(source.requests[0].SessionName, provider.sharedCredentialsKey(config.Load(), platform["172.17.0.3"], role, "").SessionName("test"))
+
+	// The policy, the source and the role chain are part of the key
+	assert.Equal(`{"Statement":[]}`, source.requests[1].IamPolicy)
+	assert.NotEqual(source.requests[0].SessionName, source.requests[1].SessionName)
+	assert.NotEqual(source.requests[0].SessionName, other.requests[0].SessionName)
+	assert.Equal(chain, source.requests[2].RoleChain)
+	assert.NotEqual(source.requests[0].SessionName, source.requests[2].SessionName)
+
+	// Sessions of chained roles are limited to 1 hour
+	assert.Equal(2*time.Hour, source.requests[0].Duration)
+	assert.Equal(time.Hour, source.requests[2].Duration)
+
+	// Evicting removes the shared credentials stored before a reload changed
+	// the key
+	testConfigure(config, func(cfg *reloadableConfig) { cfg.SessionDuration = time.Hour })
+	assert.Equal(1, provider.Evict("172.17.0.2"))
+	_, err := provider.CredentialsForIP("172.17.0.3")
+	assert.Nil(err)
+	_, err = provider.CredentialsForIP("172.17.0.2")
+	assert.Nil(err)
+	assert.Len(source.requests, 4)
+	assert.Equal(time.Hour, source.requests[3].Duration)
+	assert.Len(provider.sharedCredentials, 4)
+}
+
+// blockingCredentialSource blocks requests for a role until the role is
+// released.
+type blockingCredentialSource struct {
+	calls   chan string
+	release map[string]chan struct{}
+}
+
+func (s *blockingCredentialSource) Credentials(req credentialsRequest) (credentials, error) {
+	s.calls <- req.Role.RoleArn.RoleName()
+
+	if release, found := s.release[req.Role.RoleArn.RoleName()]; found {
+		<-release
+	}
+
+	return newStaticCredentialSource("AKID", "SECRET", "TOKEN").Credentials(req)
+}
+
+func TestCredentialsConcurrentRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	slowRole, _ := newRoleArn("arn:aws:iam::123456789012:role/slow")
+	fastRole, _ := newRoleArn("arn:aws:iam::123456789012:role/fast")
+	platform := testContainerService{
+		"172.17.0.2": {ID: "a", IamRole: slowRole},
+		"172.17.0.3": {ID: "b", IamRole: fastRole},
+	}
+	source := &blockingCredentialSource{
+		calls:   make(chan string, 10),
+		release: map[string]chan struct{}{"slow": make(chan struct{})},
+	}
+	provider := newCredentialsProvider(platform, map[string]credentialSource{"static": source}, "static", newTestConfig(), nil)
+
+	results := make(chan error, 2)
+
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := provider.CredentialsForIP("172.17.0.2")
+			results <- err
+		}()
+	}
+
+	assert.Equal("slow", <-source.calls)
+
+	// A slow request for one role does not block the other roles
+	creds, err := provider.CredentialsForIP("172.17.0.3")
+	assert.Nil(err)
+	assert.Equal(fastRole, creds.RoleArn)
+	assert.Equal("fast", <-source.calls)
+
+	// Concurrent requests for the same role share one request
+	close(source.release["slow"])
+	assert.Nil(<-results)
+	assert.Nil(<-results)
+	assert.Len(source.calls, 0)
+}
@@ -2,7 +2,8 @@ package main
 
 import (
 	"fmt"
-	"strings"
+	"sort"
+	"sync"
 	"time"
 
 	log "github.com/cihub/seelog"
@@ -11,12 +12,16 @@ import (
 
 type dockerContainerInfo struct {
 	containerInfo
+	Container   *docker.Container
 	RefreshTime time.Time
 }
 
 type dockerContainerService struct {
 	containerIPMap map[string]dockerContainerInfo
 	docker         *docker.Client
+	// Set when the containers were synchronized at least once
+	synced bool
+	lock   sync.Mutex
 }
 
 func newDockerContainerService(endpoint string) (*dockerContainerService, error) {
@@ -37,6 +42,47 @@ func (d *dockerContainerService) TypeName() string {
 }
 
 func (d *dockerContainerService) ContainerForIP(containerIP string) (containerInfo, error) {
+	info, err := d.dockerContainerForIP(containerIP)
+	return info.containerInfo, err
+}
+
+// DockerContainerForIP returns the docker inspect data of the container.
+func (d *dockerContainerService) DockerContainerForIP(containerIP string) (*docker.Container, error) {
+	info, err := d.dockerContainerForIP(containerIP)
+	return info.Container, err
+}
+
+// ContainerStats returns a single sample of the docker stats of the container.
+func (d *dockerContainerService) ContainerStats(containerID string) (*docker.Stats, error) {
+	statsC := make(chan *docker.Stats, 1)
+	errC := make(chan error, 1)
+
+	go func() {
+		errC <- d.docker.Stats(docker.StatsOptions{
+			ID:      containerID,
+			Stats:   statsC,
+			Stream:  false,
+			Timeout: 10 * time.Second,
+		})
+	}()
+
+	stats, ok := <-statsC
+
+	if err := <-errC; err != nil {
+		return nil, err
+	}
+
+	if !ok || stats == nil {
+		return nil, fmt.Errorf("No stats returned for container %s", containerID)
+	}
+
+	return stats, nil
+}
+
+func (d *dockerContainerService) dockerContainerForIP(containerIP string) (dockerContainerInfo, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
 	info, found := d.containerIPMap[containerIP]
 	now := time.Now()
 
@@ -48,10 +94,41 @@ func (d *dockerContainerService) ContainerForIP(containerIP string) (containerIn
 	}
 
 	if !found {
-		return containerInfo{}, fmt.Errorf("No container found for IP %s", containerIP)
+		return dockerContainerInfo{}, fmt.Errorf("No container found for IP %s", containerIP)
 	}
 
-	return info.containerInfo, nil
+	return info, nil
+}
+
+// Containers returns the known containers, one for each IP, ordered by IP.
+func (d *dockerContainerService) Containers() []containerInfo {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	containers := make([]containerInfo, 0, len(d.containerIPMap))
+
+	for _, info := range d.containerIPMap {
+		containers = append(containers, info.containerInfo)
+	}
+
+	sort.Slice(containers, func(i, j int) bool { return containers[i].IPAddress < containers[j].IPAddress })
+	return containers
+}
+
+// Sync refreshes the known containers from the running docker containers.
+func (d *dockerContainerService) Sync() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.syncContainers(time.Now())
+}
+
+// Synced returns true if the containers were synchronized at least once.
+func (d *dockerContainerService) Synced() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.synced
 }
 
 func (d *dockerContainerService) syncContainer(containerIP string, oldInfo dockerContainerInfo, now time.Time) (dockerContainerInfo, bool) {
@@ -70,6 +147,7 @@ func (d *dockerContainerService) syncContainer(containerIP string, oldInfo docke
 		return info, found
 	}
 
+	oldInfo.Container = container
 	oldInfo.RefreshTime = refreshTime(now)
 	d.containerIPMap[containerIP] = oldInfo
 	return oldInfo, true
@@ -106,12 +184,13 @@ func (d *dockerContainerService) syncContainers(now time.Time) {
 			continue
 		}
 
-		var containerIPs []string
+		// IP address -> MAC address
+		containerIPs := make(map[string]string)
 		if container.NetworkSettings.IPAddress != "" {
-			containerIPs = append(containerIPs, container.NetworkSettings.IPAddress)
+			containerIPs[container.NetworkSettings.IPAddress] = container.NetworkSettings.MacAddress
 		}
 		for _, network := range container.NetworkSettings.Networks {
-			containerIPs = append(containerIPs, network.IPAddress)
+			containerIPs[network.IPAddress] = network.MacAddress
 		}
 
 		if len(containerIPs) == 0 {
@@ -119,53 +198,38 @@ func (d *dockerContainerService) syncContainers(now time.Time) {
 			continue
 		}
 
-		roleArn, iamPolicy, err := getRoleArnFromEnv(container.Config.Env)
+		info, err := newContainerInfo(container.ID, container.Name, envMap(container.Config.Env))
 
 		if err != nil {
 			log.Error("Error getting role from container: ", apiContainer.ID, ": ", err)
 			continue
 		}
 
-		for _, ipAddress := range containerIPs {
-			log.Infof("Container: id=%s ip=%s image=%s role=%s", container.ID[:6], ipAddress, container.Config.Image, roleArn)
+		info.Image = container.Config.Image
+		info.Labels = container.Config.Labels
+		info.Hostname = container.Config.Hostname
+
+		if len(container.Config.Domainname) > 0 {
+			info.Hostname += "." + container.Config.Domainname
+		}
+
+		for ipAddress, macAddress := range containerIPs {
+			log.Infof("Container: id=%s ip=%s image=%s role=%s", container.ID[:6], ipAddress, container.Config.Image, info.IamRole)
+			info.IPAddress = ipAddress
+			info.MacAddress = macAddress
 
 			containerIPMap[ipAddress] = dockerContainerInfo{
-				containerInfo: containerInfo{
-					ID:        container.ID,
-					Name:      container.Name,
-					IamRole:   roleArn,
-					IamPolicy: iamPolicy,
-				},
-				RefreshTime: refreshAt,
+				containerInfo: info,
+				Container:     container,
+				RefreshTime:   refreshAt,
 			}
 		}
 	}
 
 	d.containerIPMap = containerIPMap
+	d.synced = true
 }
 
 func refreshTime(now time.Time) time.Time {
 	return now.Add(1 * time.Second)
 }
-
-func getRoleArnFromEnv(env []string) (role roleArn, policy string, err error) {
-	for _, e := range env {
-		v := strings.SplitN(e, "=", 2)
-
-		if v[0] == "IAM_ROLE" && len(v) > 1 {
-			roleArn := strings.TrimSpace(v[1])
-
-			if len(roleArn) > 0 {
-				role, err = newRoleArn(roleArn)
-
-				if err != nil {
-					return
-				}
-			}
-		} else if v[0] == "IAM_POLICY" && len(v) > 1 {
-			policy = strings.TrimSpace(v[1])
-		}
-	}
-
-	return
-}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	ecsEndpointIP      = "169.254.170.2"
+	ecsCredentialsPath = "/v2/credentials/"
+	ecsMetadataPath    = "/v4/"
+)
+
+// containerTokens issues identifiers and authorization tokens that are bound
+// to a container id. They are derived from a secret, so they do not need to be
+// stored and are the same for a container for as long as the secret does not
+// change.
+type containerTokens struct {
+	secret []byte
+}
+
+func newContainerTokens(secretFile string) (*containerTokens, error) {
+	if len(secretFile) == 0 {
+		secret := make([]byte, 32)
+
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+
+		return &containerTokens{secret}, nil
+	}
+
+	secret, err := ioutil.ReadFile(secretFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	secret = []byte(strings.TrimSpace(string(secret)))
+
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("Container token secret in %s must be at least 16 bytes", secretFile)
+	}
+
+	return &containerTokens{secret}, nil
+}
+
+func (t *containerTokens) mac(purpose, containerID string) []byte {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(purpose + ":" + containerID))
+	return mac.Sum(nil)
+}
+
+// ID returns an identifier for the container that can be used in URLs.
+func (t *containerTokens) ID(containerID string) string {
+	return hex.EncodeToString(t.mac("id", containerID)[:16])
+}
+
+// Token returns the secret authorization token for the container.
+func (t *containerTokens) Token(containerID string) string {
+	return base64.RawURLEncoding.EncodeToString(t.mac("token", containerID))
+}
+
+// ValidID returns true if id is the identifier of the container.
+func (t *containerTokens) ValidID(containerID, id string) bool {
+	return subtle.ConstantTimeCompare([]byte(t.ID(containerID)), []byte(id)) == 1
+}
+
+// ValidToken returns true if token is the authorization token of the container.
+func (t *containerTokens) ValidToken(containerID, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(t.Token(containerID)), []byte(token)) == 1
+}
+
+type ecsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	Expiration      string
+	RoleArn         string
+}
+
+type ecsError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeECSError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	data, _ := json.Marshal(ecsError{code, message})
+	w.Write(data)
+}
+
+// ecsHandler emulates the ECS container credentials endpoint and the ECS task
+// metadata endpoint for containers that are not run by ECS.
+type ecsHandler struct {
+	platform containerService
+	tokens   *containerTokens
+	// Metadata access rules of the containers
+	config *liveConfig
+	// nil if the credentials endpoint is disabled
+	credentials *credentialsProvider
+	// nil if the task metadata endpoint is disabled
+	metadata *ecsMetadata
+	// nil if the EKS Pod Identity endpoint is disabled
+	podIdentity *podIdentityHandler
+}
+
+func newECSHandler(platform containerService, tokens *containerTokens, config *liveConfig) *ecsHandler {
+	return &ecsHandler{platform: platform, tokens: tokens, config: config}
+}
+
+// HandleCredentials serves the credentials for AWS_CONTAINER_CREDENTIALS_RELATIVE_URI
+// and AWS_CONTAINER_CREDENTIALS_FULL_URI. The request must come from the
+// container's IP and carry the container's authorization token.
+func (e *ecsHandler) HandleCredentials(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeECSError(w, http.StatusMethodNotAllowed, "InvalidRequest", "Method not allowed")
+		return
+	}
+
+	clientIP := remoteIP(r.RemoteAddr)
+	container, err := e.platform.ContainerForIP(clientIP)
+
+	if err != nil {
+		log.Error(clientIP, " ", err)
+		writeECSError(w, http.StatusBadRequest, "InvalidIdError", "No container found for request")
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, ecsCredentialsPath)
+
+	if !e.tokens.ValidID(container.ID, id) {
+		writeECSError(w, http.StatusBadRequest, "InvalidIdError", "Invalid credentials id")
+		return
+	}
+
+	if !e.tokens.ValidToken(container.ID, r.Header.Get("Authorization")) {
+		writeECSError(w, http.StatusUnauthorized, "AccessDenied", "Invalid authorization token")
+		return
+	}
+
+	if !e.config.Load().ContainerACL(container).Allowed(securityCredentialsPath) {
+		log.Debug("Credentials are denied for ", clientIP)
+		writeECSError(w, http.StatusForbidden, "AccessDenied", "Credentials are denied for container")
+		return
+	}
+
+	credentials, err := e.credentials.CredentialsForIP(clientIP)
+
+	if err == errNoCredentials || err == errInstanceProfile {
+		writeECSError(w, http.StatusNotFound, "NoCredentials", "No credentials for container")
+		return
+	} else if err != nil {
+		log.Error(clientIP, " ", err)
+		writeECSError(w, http.StatusInternalServerError, "InternalServerError", "An unexpected error getting container role")
+		return
+	}
+
+	writeJSON(w, &ecsCredentials{
+		AccessKeyID:     credentials.AccessKey,
+		SecretAccessKey: credentials.SecretKey,
+		Token:           credentials.Token,
+		Expiration:      credentials.Expiration.UTC().Format(time.RFC3339),
+		RoleArn:         credentials.RoleArn.String(),
+	})
+}
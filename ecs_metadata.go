@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// dockerMetadataService is implemented by container services that can provide
+// the docker inspect and stats data of a container.
+type dockerMetadataService interface {
+	DockerContainerForIP(containerIP string) (*docker.Container, error)
+	ContainerStats(containerID string) (*docker.Stats, error)
+}
+
+type ecsContainerLimits struct {
+	CPU    int64 `json:"CPU"`
+	Memory int64 `json:"Memory"`
+}
+
+type ecsContainerNetwork struct {
+	NetworkMode   string   `json:"NetworkMode"`
+	IPv4Addresses []string `json:"IPv4Addresses"`
+	MACAddress    string   `json:"MACAddress,omitempty"`
+}
+
+type ecsContainerMetadata struct {
+	DockerID      string                `json:"DockerId"`
+	Name          string                `json:"Name"`
+	DockerName    string                `json:"DockerName"`
+	Image         string                `json:"Image"`
+	ImageID       string                `json:"ImageID"`
+	Labels        map[string]string     `json:"Labels,omitempty"`
+	DesiredStatus string                `json:"DesiredStatus"`
+	KnownStatus   string                `json:"KnownStatus"`
+	Limits        ecsContainerLimits    `json:"Limits"`
+	CreatedAt     *time.Time            `json:"CreatedAt,omitempty"`
+	StartedAt     *time.Time            `json:"StartedAt,omitempty"`
+	Type          string                `json:"Type"`
+	LogDriver     string                `json:"LogDriver,omitempty"`
+	LogOptions    map[string]string     `json:"LogOptions,omitempty"`
+	Networks      []ecsContainerNetwork `json:"Networks"`
+}
+
+type ecsTaskMetadata struct {
+	Cluster          string                 `json:"Cluster"`
+	TaskARN          string                 `json:"TaskARN"`
+	Family           string                 `json:"Family"`
+	Revision         string                 `json:"Revision"`
+	DesiredStatus    string                 `json:"DesiredStatus"`
+	KnownStatus      string                 `json:"KnownStatus"`
+	Containers       []ecsContainerMetadata `json:"Containers"`
+	Limits           ecsContainerLimits     `json:"Limits"`
+	PullStartedAt    *time.Time             `json:"PullStartedAt,omitempty"`
+	PullStoppedAt    *time.Time             `json:"PullStoppedAt,omitempty"`
+	AvailabilityZone string                 `json:"AvailabilityZone,omitempty"`
+	LaunchType       string                 `json:"LaunchType"`
+}
+
+// ecsMetadata builds ECS task metadata (version 4) from docker inspect data.
+// Each container is presented as a task with a single container.
+type ecsMetadata struct {
+	docker   dockerMetadataService
+	cluster  string
+	identity *instanceIdentityDocument
+	lock     sync.Mutex
+}
+
+func newECSMetadata(docker dockerMetadataService, cluster string) *ecsMetadata {
+	return &ecsMetadata{docker: docker, cluster: cluster}
+}
+
+func (m *ecsMetadata) instanceIdentity() instanceIdentityDocument {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.identity == nil {
+		identity, err := fetchInstanceIdentity()
+
+		if err != nil {
+			log.Warn("Error fetching instance identity for ECS task metadata: ", err)
+			return identity
+		}
+
+		m.identity = &identity
+	}
+
+	return *m.identity
+}
+
+func (m *ecsMetadata) Container(container *docker.Container) ecsContainerMetadata {
+	name := strings.TrimPrefix(container.Name, "/")
+	status := "STOPPED"
+
+	if container.State.Running {
+		status = "RUNNING"
+	}
+
+	metadata := ecsContainerMetadata{
+		DockerID:      container.ID,
+		Name:          name,
+		DockerName:    name,
+		ImageID:       container.Image,
+		DesiredStatus: status,
+		KnownStatus:   status,
+		Type:          "NORMAL",
+		Networks:      []ecsContainerNetwork{},
+	}
+
+	if !container.Created.IsZero() {
+		metadata.CreatedAt = &container.Created
+	}
+
+	if !container.State.StartedAt.IsZero() {
+		metadata.StartedAt = &container.State.StartedAt
+	}
+
+	if container.Config != nil {
+		metadata.Image = container.Config.Image
+		metadata.Labels = container.Config.Labels
+	}
+
+	if container.HostConfig != nil {
+		metadata.Limits = ecsContainerLimits{
+			CPU:    container.HostConfig.CPUShares,
+			Memory: container.HostConfig.Memory / (1024 * 1024),
+		}
+		metadata.LogDriver = container.HostConfig.LogConfig.Type
+		metadata.LogOptions = container.HostConfig.LogConfig.Config
+	}
+
+	if container.NetworkSettings != nil {
+		var networkNames []string
+
+		for networkName := range container.NetworkSettings.Networks {
+			networkNames = append(networkNames, networkName)
+		}
+
+		sort.Strings(networkNames)
+
+		for _, networkName := range networkNames {
+			network := container.NetworkSettings.Networks[networkName]
+			metadata.Networks = append(metadata.Networks, ecsContainerNetwork{
+				NetworkMode:   networkName,
+				IPv4Addresses: []string{network.IPAddress},
+				MACAddress:    network.MacAddress,
+			})
+		}
+	}
+
+	return metadata
+}
+
+func (m *ecsMetadata) Task(container *docker.Container, taskID string) ecsTaskMetadata {
+	identity := m.instanceIdentity()
+	containerMetadata := m.Container(container)
+	taskARN := ""
+
+	if len(identity.Region) > 0 {
+		taskARN = fmt.Sprintf("arn:%s:ecs:%s:%s:task/%s/%s", regionPartition(identity.Region), identity.Region, identity.AccountID, m.cluster, taskID)
+	}
+
+	return ecsTaskMetadata{
+		Cluster:          m.cluster,
+		TaskARN:          taskARN,
+		Family:           containerMetadata.Name,
+		Revision:         "1",
+		DesiredStatus:    containerMetadata.DesiredStatus,
+		KnownStatus:      containerMetadata.KnownStatus,
+		Containers:       []ecsContainerMetadata{containerMetadata},
+		Limits:           containerMetadata.Limits,
+		AvailabilityZone: identity.AvailabilityZone,
+		LaunchType:       "EC2",
+	}
+}
+
+// HandleMetadata serves /v4/<id>, /v4/<id>/task, /v4/<id>/stats and
+// /v4/<id>/task/stats for ECS_CONTAINER_METADATA_URI_V4. The request must come
+// from the container's IP and use the container's id.
+func (e *ecsHandler) HandleMetadata(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, ecsMetadataPath), "/")
+	parts := strings.SplitN(path, "/", 2)
+	id, resource := parts[0], ""
+
+	if len(parts) > 1 {
+		resource = parts[1]
+	}
+
+	clientIP := remoteIP(r.RemoteAddr)
+	container, err := e.metadata.docker.DockerContainerForIP(clientIP)
+
+	if err != nil {
+		log.Error(clientIP, " ", err)
+		writeECSError(w, http.StatusNotFound, "InvalidIdError", "No container found for request")
+		return
+	}
+
+	if !e.tokens.ValidID(container.ID, id) {
+		writeECSError(w, http.StatusNotFound, "InvalidIdError", "Invalid metadata id")
+		return
+	}
+
+	if info, err := e.platform.ContainerForIP(clientIP); err != nil || e.config.Load().ContainerACL(info).disabled {
+		log.Debug("Metadata is disabled for ", clientIP)
+		writeECSError(w, http.StatusForbidden, "AccessDenied", "Metadata is disabled for container")
+		return
+	}
+
+	switch resource {
+	case "":
+		writeJSON(w, e.metadata.Container(container))
+	case "task":
+		writeJSON(w, e.metadata.Task(container, id))
+	case "stats":
+		stats, err := e.metadata.docker.ContainerStats(container.ID)
+
+		if err != nil {
+			log.Error("Error getting stats for container ", container.ID, ": ", err)
+			writeECSError(w, http.StatusInternalServerError, "InternalServerError", "Unable to get container stats")
+			return
+		}
+
+		writeJSON(w, stats)
+	case "task/stats":
+		stats, err := e.metadata.docker.ContainerStats(container.ID)
+
+		if err != nil {
+			log.Error("Error getting stats for container ", container.ID, ": ", err)
+			writeECSError(w, http.StatusInternalServerError, "InternalServerError", "Unable to get container stats")
+			return
+		}
+
+		writeJSON(w, map[string]*docker.Stats{container.ID: stats})
+	default:
+		writeECSError(w, http.StatusNotFound, "InvalidRequest", "Unknown metadata path")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestECSCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	platform := testContainerService{
+		"172.17.0.2": {ID: "container-a"},
+		"172.17.0.3": {ID: "container-b"},
+		"172.17.0.5": {ID: "container-d", Labels: map[string]string{"ec2metaproxy.disabled": "true"}},
+	}
+	tokens, err := newContainerTokens("")
+	assert.Nil(err)
+	ecs := newECSHandler(platform, tokens, newTestConfig())
+	ecs.credentials = newTestCredentialsProvider(platform)
+
+	w := testRequest(ecs.HandleCredentials, "GET", ecsCredentialsPath+tokens.ID("container-a"), "172.17.0.2", "Authorization: "+tokens.Token("container-a"))
+	assert.Equal(http.StatusOK, w.Code)
+
+	var creds ecsCredentials
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &creds))
+	assert.Equal("AKID", creds.AccessKeyID)
+	assert.Equal("SECRET", creds.SecretAccessKey)
+	assert.Equal("TOKEN", creds.Token)
+	assert.Equal("arn:aws:iam::123456789012:role/test-role-name", creds.RoleArn)
+	_, err = time.Parse(time.RFC3339, creds.Expiration)
+	assert.Nil(err)
+
+	// Token of another container
+	assert.Equal(http.StatusUnauthorized, testRequest(ecs.HandleCredentials, "GET", ecsCredentialsPath+tokens.ID("container-a"), "172.17.0.2", "Authorization: "+tokens.Token("container-b")).Code)
+	assert.Equal(http.StatusUnauthorized, testRequest(ecs.HandleCredentials, "GET", ecsCredentialsPath+tokens.ID("container-a"), "172.17.0.2", "Authorization: ").Code)
+
+	// Id of another container
+	assert.Equal(http.StatusBadRequest, testRequest(ecs.HandleCredentials, "GET", ecsCredentialsPath+tokens.ID("container-b"), "172.17.0.2", "Authorization: "+tokens.Token("container-b")).Code)
+
+	// Unknown source IP
+	assert.Equal(http.StatusBadRequest, testRequest(ecs.HandleCredentials, "GET", ecsCredentialsPath+tokens.ID("container-a"), "172.17.0.4", "Authorization: "+tokens.Token("container-a")).Code)
+
+	// Metadata access rules apply
+	assert.Equal(http.StatusForbidden, testRequest(ecs.HandleCredentials, "GET", ecsCredentialsPath+tokens.ID("container-d"), "172.17.0.5", "Authorization: "+tokens.Token("container-d")).Code)
+
+	testConfigure(ecs.config, func(cfg *reloadableConfig) {
+		cfg.MetadataACL = newMetadataACL(nil, []string{"iam/security-credentials"})
+	})
+	assert.Equal(http.StatusForbidden, testRequest(ecs.HandleCredentials, "GET", ecsCredentialsPath+tokens.ID("container-a"), "172.17.0.2", "Authorization: "+tokens.Token("container-a")).Code)
+}
+
+type testDockerMetadataService map[string]*docker.Container
+
+func (t testDockerMetadataService) DockerContainerForIP(containerIP string) (*docker.Container, error) {
+	if container, found := t[containerIP]; found {
+		return container, nil
+	}
+
+	return nil, fmt.Errorf("No container found for IP %s", containerIP)
+}
+
+func (t testDockerMetadataService) ContainerStats(containerID string) (*docker.Stats, error) {
+	return &docker.Stats{}, nil
+}
+
+func TestECSMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	container := &docker.Container{
+		ID:    "container-a",
+		Name:  "/web",
+		Image: "sha256:abc",
+		State: docker.State{Running: true},
+		Config: &docker.Config{
+			Image:  "nginx:latest",
+			Labels: map[string]string{"team": "web"},
+		},
+		HostConfig: &docker.HostConfig{CPUShares: 512, Memory: 256 * 1024 * 1024},
+		NetworkSettings: &docker.NetworkSettings{
+			Networks: map[string]docker.ContainerNetwork{
+				"bridge": {IPAddress: "172.17.0.2", MacAddress: "02:42:ac:11:00:02"},
+			},
+		},
+	}
+
+	disabled := &docker.Container{ID: "container-d", Config: &docker.Config{}, HostConfig: &docker.HostConfig{}, NetworkSettings: &docker.NetworkSettings{}}
+	services := testDockerMetadataService{"172.17.0.2": container, "172.17.0.5": disabled}
+	platform := testContainerService{
+		"172.17.0.2": {ID: "container-a"},
+		"172.17.0.5": {ID: "container-d", Labels: map[string]string{"ec2metaproxy.disabled": "true"}},
+	}
+	tokens, err := newContainerTokens("")
+	assert.Nil(err)
+	ecs := newECSHandler(platform, tokens, newTestConfig())
+	ecs.metadata = newECSMetadata(services, "test-cluster")
+	ecs.metadata.identity = &instanceIdentityDocument{AccountID: "123456789012", AvailabilityZone: "us-east-1a", Region: "us-east-1"}
+
+	id := tokens.ID("container-a")
+	w := testRequest(ecs.HandleMetadata, "GET", ecsMetadataPath+id, "172.17.0.2")
+	assert.Equal(http.StatusOK, w.Code)
+
+	var metadata ecsContainerMetadata
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &metadata))
+	assert.Equal("container-a", metadata.DockerID)
+	assert.Equal("web", metadata.Name)
+	assert.Equal("nginx:latest", metadata.Image)
+	assert.Equal("RUNNING", metadata.KnownStatus)
+	assert.Equal(ecsContainerLimits{CPU: 512, Memory: 256}, metadata.Limits)
+	assert.Equal([]ecsContainerNetwork{{NetworkMode: "bridge", IPv4Addresses: []string{"172.17.0.2"}, MACAddress: "02:42:ac:11:00:02"}}, metadata.Networks)
+
+	w = testRequest(ecs.HandleMetadata, "GET", ecsMetadataPath+id+"/task", "172.17.0.2")
+	assert.Equal(http.StatusOK, w.Code)
+
+	var task ecsTaskMetadata
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &task))
+	assert.Equal("arn:aws:ecs:us-east-1:123456789012:task/test-cluster/"+id, task.TaskARN)
+	assert.Equal("us-east-1a", task.AvailabilityZone)
+	assert.Len(task.Containers, 1)
+
+	assert.Equal(http.StatusOK, testRequest(ecs.HandleMetadata, "GET", ecsMetadataPath+id+"/stats", "172.17.0.2").Code)
+	assert.Equal(http.StatusOK, testRequest(ecs.HandleMetadata, "GET", ecsMetadataPath+id+"/task/stats", "172.17.0.2").Code)
+	assert.Equal(http.StatusNotFound, testRequest(ecs.HandleMetadata, "GET", ecsMetadataPath+id+"/other", "172.17.0.2").Code)
+	assert.Equal(http.StatusNotFound, testRequest(ecs.HandleMetadata, "GET", ecsMetadataPath+tokens.ID("container-b"), "172.17.0.2").Code)
+	assert.Equal(http.StatusNotFound, testRequest(ecs.HandleMetadata, "GET", ecsMetadataPath+id, "172.17.0.3").Code)
+
+	// Containers with disabled metadata can not read the task metadata
+	assert.Equal(http.StatusForbidden, testRequest(ecs.HandleMetadata, "GET", ecsMetadataPath+tokens.ID("container-d"), "172.17.0.5").Code)
+}
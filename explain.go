@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// runExplain runs the explain command with the flags and the configuration.
+func runExplain(config *liveConfig) error {
+	platform, err := newContainerService(*explainPlatform, *explainEndpoint)
+
+	if err != nil {
+		return err
+	}
+
+	// STS is only created if credentials are requested
+	awsSts := newLazySTSClient(newSTSClientFromFlags)
+	credentials, err := newCredentialsProviderFromFlags(platform, awsSts, nil, config)
+
+	if err != nil {
+		return err
+	}
+
+	container, err := findContainer(platform, *explainIP, *explainContainerRef)
+
+	if err != nil {
+		return err
+	}
+
+	return explain(os.Stdout, credentials, container, *explainAssume)
+}
+
+// findContainer returns the container with the IP, or the container with the
+// ID, ID prefix or name if ip is empty.
+func findContainer(platform containerService, ip, ref string) (containerInfo, error) {
+	if len(ip) > 0 {
+		return platform.ContainerForIP(ip)
+	}
+
+	if len(ref) == 0 {
+		return containerInfo{}, fmt.Errorf("Container IP, ID or name is required")
+	}
+
+	platform.Sync()
+
+	var found *containerInfo
+
+	for _, container := range platform.Containers() {
+		container := container
+
+		if container.ID != ref && !strings.HasPrefix(container.ID, ref) && strings.TrimPrefix(container.Name, "/") != strings.TrimPrefix(ref, "/") {
+			continue
+		}
+
+		if found != nil && found.ID != container.ID {
+			return containerInfo{}, fmt.Errorf("More than one container matches %s", ref)
+		}
+
+		if found == nil {
+			found = &container
+		}
+	}
+
+	if found == nil {
+		return containerInfo{}, fmt.Errorf("No container found for %s", ref)
+	}
+
+	return *found, nil
+}
+
+// explain writes how the role, policy and credential source of the container
+// are resolved and whether the container is allowed to use them. Credentials
+// are only requested if assume is true. Returns an error if the container can
+// not get credentials.
+func explain(out io.Writer, c *credentialsProvider, container containerInfo, assume bool) error {
+	line := func(name, format string, args ...interface{}) {
+		fmt.Fprintf(out, "%-19s %s\n", name+":", fmt.Sprintf(format, args...))
+	}
+
+	cfg := c.config.Load()
+	acl := cfg.MetadataACL
+	platform := c.container.TypeName()
+	line("Platform", "%s", platform)
+	line("Container", "%s", container.ID)
+	line("Name", "%s", strings.TrimPrefix(container.Name, "/"))
+	line("Image", "%s", container.Image)
+	line("IP address", "%s", container.IPAddress)
+
+	if cfg.Overrides != nil {
+		for i, rule := range cfg.Overrides.rules {
+			if rule.Matches(container) {
+				line("Override rule", "%d", i+1)
+			}
+		}
+
+		acl = cfg.Overrides.ACL(container, acl)
+	}
+
+	if acl.disabled {
+		line("Metadata", "disabled")
+	} else if !acl.Allowed(securityCredentialsPath) {
+		line("Metadata", "%s denied", securityCredentialsPath)
+	} else {
+		line("Metadata", "%s allowed", securityCredentialsPath)
+	}
+
+	line("Role source", "%s", explainRoleSource(cfg, container))
+	decisions, iamPolicy, err := c.rolesForContainer(cfg, container)
+
+	switch {
+	case err == errNoCredentials:
+		line("Role", "none (no credentials)")
+		return nil
+	case err == errInstanceProfile:
+		line("Role", "instance profile")
+		return nil
+	}
+
+	var roles []roleArn
+
+	for _, decision := range decisions {
+		if decision.Primary {
+			line("Role", "%s (primary, %s)", decision.Role, decision.Reason)
+		} else {
+			line("Role", "%s (%s)", decision.Role, decision.Reason)
+		}
+
+		if decision.Allowed {
+			roles = append(roles, decision.Role)
+		}
+	}
+
+	if len(container.IamRoleChain) > 0 {
+		line("Role chain", "%s", container.IamRoleChain)
+	}
+
+	if len(container.IamExternalID) > 0 {
+		line("External ID", "%s", container.IamExternalID)
+	}
+
+	switch {
+	case len(container.IamPolicyName) > 0:
+		line("Policy source", "IAM_POLICY_NAME=%s", container.IamPolicyName)
+	case len(container.IamPolicy) > 0:
+		line("Policy source", "IAM_POLICY")
+	case len(iamPolicy) > 0:
+		line("Policy source", "--default-iam-policy")
+	default:
+		line("Policy source", "none")
+	}
+
+	if len(iamPolicy) > 0 {
+		line("Policy hash", "%s", policyHash(iamPolicy))
+	}
+
+	if err != nil {
+		line("Error", "%s", err)
+		return err
+	}
+
+	sourceName, sourceFrom := container.CredentialSource, "IAM_CREDENTIAL_SOURCE"
+
+	if len(sourceName) == 0 {
+		sourceName, sourceFrom = c.defaultSource, "--credential-source"
+	}
+
+	if _, found := c.sources[sourceName]; found {
+		line("Credential source", "%s (%s)", sourceName, sourceFrom)
+	} else {
+		line("Credential source", "%s (%s, not configured)", sourceName, sourceFrom)
+	}
+
+	for _, role := range roles {
+		req := c.credentialsRequest(cfg, container, role, iamPolicy)
+
+		if c.sharesCredentials(cfg, container) {
+			req.SessionName = c.sharedCredentialsKey(cfg, container, role, iamPolicy).SessionName(platform)
+		}
+
+		line("Session name", "%s (%s)", req.SessionName, role.RoleName())
+	}
+
+	// None of the credential sources send session tags
+	line("Session tags", "none")
+
+	line("Session duration", "%s", containerSessionDuration(cfg, container))
+
+	if !assume {
+		return nil
+	}
+
+	for _, role := range roles {
+		creds, err := c.CredentialsForRole(container.IPAddress, role.RoleName())
+
+		if err != nil {
+			line("Credentials", "%s: %s", role.RoleName(), err)
+			return err
+		}
+
+		line("Credentials", "%s: access key %s, expires %s", role.RoleName(), creds.AccessKey, creds.Expiration.UTC().Format("2006-01-02T15:04:05Z"))
+	}
+
+	return nil
+}
+
+// explainRoleSource describes where the role or the behavior of a container
+// without a role comes from, in the order of precedence used by RoleBehavior.
+func explainRoleSource(cfg *reloadableConfig, container containerInfo) string {
+	switch {
+	case len(container.NoRoleBehavior) > 0:
+		return "IAM_ROLE=:" + container.NoRoleBehavior + explainInstanceProfile(cfg, container.NoRoleBehavior)
+	case !container.IamRole.Empty():
+		return "IAM_ROLE"
+	case len(container.IamRoles) > 0:
+		return "IAM_ROLES"
+	}
+
+	behavior := ""
+
+	if cfg.Overrides != nil {
+		behavior = cfg.Overrides.NoRoleBehavior(container)
+	}
+
+	if len(behavior) > 0 {
+		return "override rule no_role_behavior=" + behavior + explainInstanceProfile(cfg, behavior)
+	}
+
+	if !cfg.DefaultIamRole.Empty() {
+		return "--default-iam-role"
+	}
+
+	return "--no-role-behavior=" + cfg.NoRoleBehavior + explainInstanceProfile(cfg, cfg.NoRoleBehavior)
+}
+
+func explainInstanceProfile(cfg *reloadableConfig, behavior string) string {
+	if behavior == noRoleInstanceProfile && !cfg.AllowInstanceProfile {
+		return " (instance profile not allowed, using none)"
+	}
+
+	return ""
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplain(t *testing.T) {
+	assert := assert.New(t)
+
+	appRole, _ := newRoleArn("arn:aws:iam::123456789012:role/app")
+	otherRole, _ := newRoleArn("arn:aws:iam::210987654321:role/other")
+	platform := testContainerService{
+		"172.17.0.2": {ID: "container-a", IPAddress: "172.17.0.2", Name: "/a", IamPolicy: `{"Statement":[]}`},
+		"172.17.0.3": {ID: "container-b", IPAddress: "172.17.0.3", Name: "/b", IamRole: appRole, IamRoles: []roleArn{otherRole}},
+		"172.17.0.4": {ID: "container-c", IPAddress: "172.17.0.4", Name: "/c", NoRoleBehavior: noRoleNone},
+	}
+	credentials := newTestCredentialsProvider(platform)
+	testConfigure(credentials.config, func(cfg *reloadableConfig) { cfg.AllowedRoles = rolePatterns{"arn:aws:iam::123456789012:role/*"} })
+
+	explainContainer := func(ip string, assume bool) (string, error) {
+		container, err := findContainer(platform, ip, "")
+		assert.Nil(err)
+
+		var out bytes.Buffer
+		err = explain(&out, credentials, container, assume)
+		return out.String(), err
+	}
+
+	out, err := explainContainer("172.17.0.2", false)
+	assert.Nil(err)
+	assert.Contains(out, "Role source:        --default-iam-role\n")
+	assert.Contains(out, "Role:               arn:aws:iam::123456789012:role/test-role-name (primary, allowed (default role))\n")
+	assert.Contains(out, "Policy source:      IAM_POLICY\n")
+	assert.Contains(out, "Policy hash:        "+policyHash(`{"Statement":[]}`)+"\n")
+	assert.Contains(out, "Session name:       test-container-a (test-role-name)\n")
+	assert.Contains(out, "Session tags:       none\n")
+	assert.NotContains(out, "Credentials:")
+	assert.Len(credentials.CachedCredentials("172.17.0.2"), 0)
+
+	out, err = explainContainer("172.17.0.3", false)
+	assert.Nil(err)
+	assert.Contains(out, "Role source:        IAM_ROLE\n")
+	assert.Contains(out, "Role:               arn:aws:iam::123456789012:role/app (primary, allowed)\n")
+	assert.Contains(out, "Role:               arn:aws:iam::210987654321:role/other (denied by --allowed-role)\n")
+	assert.NotContains(out, "(other)")
+	assert.Len(credentials.disallowedWarned, 0)
+
+	out, err = explainContainer("172.17.0.4", false)
+	assert.Nil(err)
+	assert.Contains(out, "Role source:        IAM_ROLE=:none\n")
+	assert.Contains(out, "Role:               none (no credentials)\n")
+
+	out, err = explainContainer("172.17.0.2", true)
+	assert.Nil(err)
+	assert.Contains(out, "Credentials:        test-role-name: access key AKID")
+	assert.NotContains(out, "SECRET")
+
+	container, err := findContainer(platform, "", "b")
+	assert.Nil(err)
+	assert.Equal("container-b", container.ID)
+
+	_, err = findContainer(platform, "", "container-")
+	assert.NotNil(err)
+
+	_, err = findContainer(platform, "", "missing")
+	assert.NotNil(err)
+}
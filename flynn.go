@@ -2,12 +2,11 @@ package main
 
 import (
 	"fmt"
-
-	"strings"
+	"sort"
+	"sync"
 	"time"
 
 	log "github.com/cihub/seelog"
-	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/cluster"
 )
 
@@ -19,6 +18,9 @@ type flynnContainerInfo struct {
 type flynnContainerService struct {
 	containerIPMap map[string]flynnContainerInfo
 	flynn          *cluster.Host
+	// Set when the containers were synchronized at least once
+	synced bool
+	lock   sync.Mutex
 }
 
 func newFlynnContainerService(endpoint string) (*flynnContainerService, error) {
@@ -35,6 +37,9 @@ func (f *flynnContainerService) TypeName() string {
 }
 
 func (f *flynnContainerService) ContainerForIP(containerIP string) (containerInfo, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
 	info, found := f.containerIPMap[containerIP]
 	now := time.Now()
 
@@ -52,6 +57,37 @@ func (f *flynnContainerService) ContainerForIP(containerIP string) (containerInf
 	return info.containerInfo, nil
 }
 
+// Containers returns the known containers, one for each IP, ordered by IP.
+func (f *flynnContainerService) Containers() []containerInfo {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	containers := make([]containerInfo, 0, len(f.containerIPMap))
+
+	for _, info := range f.containerIPMap {
+		containers = append(containers, info.containerInfo)
+	}
+
+	sort.Slice(containers, func(i, j int) bool { return containers[i].IPAddress < containers[j].IPAddress })
+	return containers
+}
+
+// Sync refreshes the known containers from the running flynn containers.
+func (f *flynnContainerService) Sync() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.syncContainers(time.Now())
+}
+
+// Synced returns true if the containers were synchronized at least once.
+func (f *flynnContainerService) Synced() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.synced
+}
+
 func (f *flynnContainerService) syncContainer(containerIP string, oldInfo flynnContainerInfo, now time.Time) (flynnContainerInfo, bool) {
 	log.Debug("Inspecting job: ", oldInfo.ID)
 	_, err := f.flynn.GetJob(oldInfo.ID)
@@ -86,35 +122,28 @@ func (f *flynnContainerService) syncContainers(now time.Time) {
 	containerIPMap := make(map[string]flynnContainerInfo)
 
 	for _, job := range jobs {
-		roleArn, err := getRoleArnFromJob(job.Job)
+		info, err := newContainerInfo(job.Job.ID, job.Job.ID, job.Job.Metadata)
 
 		if err != nil {
 			log.Error("Error getting role from container: ", job.ContainerID, ": ", err)
 			continue
 		}
 
-		log.Infof("Job: id=%s role=%s", job.Job.ID, roleArn)
+		info.Labels = job.Job.Metadata
+		info.IPAddress = job.InternalIP
 
-		containerIPMap[job.InternalIP] = flynnContainerInfo{
-			containerInfo: containerInfo{
-				ID:        job.Job.ID,
-				Name:      job.Job.ID,
-				IamRole:   roleArn,
-				IamPolicy: strings.TrimSpace(job.Job.Metadata["IAM_POLICY"]),
-			},
-			RefreshTime: refreshAt,
+		if job.Job.ImageArtifact != nil {
+			info.Image = job.Job.ImageArtifact.URI
 		}
-	}
 
-	f.containerIPMap = containerIPMap
-}
-
-func getRoleArnFromJob(job *host.Job) (roleArn, error) {
-	roleArnStr := job.Metadata["IAM_ROLE"]
+		log.Infof("Job: id=%s role=%s", job.Job.ID, info.IamRole)
 
-	if len(roleArnStr) > 0 {
-		return newRoleArn(roleArnStr)
+		containerIPMap[job.InternalIP] = flynnContainerInfo{
+			containerInfo: info,
+			RefreshTime:   refreshAt,
+		}
 	}
 
-	return roleArn{}, nil
+	f.containerIPMap = containerIPMap
+	f.synced = true
 }
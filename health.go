@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	awsclient "github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+
+	// How long the result of a readiness check is reused
+	readinessCheckTTL = 10 * time.Second
+
+	// How long the STS readiness check waits for STS
+	stsCheckTimeout = 5 * time.Second
+)
+
+var (
+	errShuttingDown = errors.New("Shutting down")
+	errNotChecked   = errors.New("Not checked yet")
+)
+
+type readinessCheck struct {
+	name  string
+	check func() error
+	// Result of the last check, reused until it expires
+	err error
+	// When the last check started
+	checkedAt time.Time
+}
+
+// readiness reports whether the proxy can serve containers. Results of the
+// checks are cached, so frequent probes do not add load to the dependencies.
+type readiness struct {
+	checks       []*readinessCheck
+	ttl          time.Duration
+	shuttingDown bool
+	lock         sync.Mutex
+}
+
+func newReadiness(ttl time.Duration) *readiness {
+	return &readiness{ttl: ttl}
+}
+
+// Add adds a check. The proxy is ready if all checks return nil.
+func (r *readiness) Add(name string, check func() error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.checks = append(r.checks, &readinessCheck{name: name, check: check, err: errNotChecked})
+}
+
+// ShuttingDown marks the proxy as not ready, so it is removed from service
+// while the active requests are drained.
+func (r *readiness) ShuttingDown() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.shuttingDown = true
+}
+
+// Check runs the checks and returns the result of each check by name, or nil
+// if the check passed.
+func (r *readiness) Check() (map[string]error, bool) {
+	r.lock.Lock()
+	shuttingDown := r.shuttingDown
+	r.lock.Unlock()
+
+	results := make(map[string]error)
+	ready := !shuttingDown
+
+	if shuttingDown {
+		results["shutdown"] = errShuttingDown
+	}
+
+	for _, result := range r.run() {
+		results[result.name] = result.err
+		ready = ready && result.err == nil
+	}
+
+	return results, ready
+}
+
+type readinessResult struct {
+	name string
+	err  error
+}
+
+// run returns the result of each check, in the order the checks were added.
+// Checks whose result expired are run again without holding the lock, so a
+// slow dependency does not block other probes. Until a check that is already
+// running returns, other probes get its previous result.
+func (r *readiness) run() []readinessResult {
+	r.lock.Lock()
+	now := time.Now()
+	var expired []*readinessCheck
+
+	for _, check := range r.checks {
+		if check.checkedAt.IsZero() || now.Sub(check.checkedAt) >= r.ttl {
+			check.checkedAt = now
+			expired = append(expired, check)
+		}
+	}
+
+	r.lock.Unlock()
+
+	errs := make([]error, len(expired))
+
+	for i, check := range expired {
+		errs[i] = check.check()
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i, check := range expired {
+		check.err = errs[i]
+	}
+
+	results := make([]readinessResult, len(r.checks))
+
+	for i, check := range r.checks {
+		results[i] = readinessResult{check.name, check.err}
+	}
+
+	return results
+}
+
+// HandleHealth reports that the process is alive.
+func (r *readiness) HandleHealth(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// HandleReady reports whether the proxy is ready, with the result of each
+// check. The status is 503 if the proxy is not ready.
+func (r *readiness) HandleReady(w http.ResponseWriter, req *http.Request) {
+	results, ready := r.Check()
+	status := make(map[string]string)
+
+	for name, err := range results {
+		if err != nil {
+			status[name] = err.Error()
+		} else {
+			status[name] = "ok"
+		}
+	}
+
+	if !ready {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	writeJSON(w, status)
+}
+
+// containerBackendCheck passes once the containers were synchronized.
+func containerBackendCheck(platform containerService) func() error {
+	return func() error {
+		if !platform.Synced() {
+			return errors.New("Containers not synchronized")
+		}
+
+		return nil
+	}
+}
+
+// serveLoops runs the loops that serve the proxy listeners and tracks whether
+// they are still running.
+type serveLoops struct {
+	stopped int32
+}
+
+// Go serves the listener in a goroutine and sends the error to errs once the
+// loop stops.
+func (s *serveLoops) Go(server *http.Server, listener net.Listener, errs chan<- error) {
+	go func() {
+		err := server.Serve(listener)
+		atomic.AddInt32(&s.stopped, 1)
+		errs <- err
+	}()
+}
+
+// livenessCheck passes while the proxy serves requests and the containers are
+// synchronized. Unlike the readiness checks, it does not depend on the
+// metadata service or STS, which the proxy can not fix by restarting. It only
+// fails if a server stopped or the containers were never synchronized: a
+// handler that hangs or a container service that stops receiving events after
+// the first synchronization is not detected.
+func livenessCheck(platform containerService, loops *serveLoops) func() error {
+	synced := containerBackendCheck(platform)
+
+	return func() error {
+		if atomic.LoadInt32(&loops.stopped) > 0 {
+			return errors.New("Server stopped")
+		}
+
+		return synced()
+	}
+}
+
+// metadataServiceCheck passes if the EC2 metadata service answers a request.
+// The request is not authenticated and does not use the cached token of the
+// proxy, so a 401 from a service that requires IMDSv2 also passes.
+func metadataServiceCheck(metadataURL string, client http.RoundTripper) func() error {
+	return func() error {
+		req, err := http.NewRequest(http.MethodHead, metadataURL+"/latest/meta-data/", nil)
+
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.RoundTrip(req)
+
+		if err != nil {
+			return err
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+			return fmt.Errorf("Metadata service returned %s", resp.Status)
+		}
+
+		return nil
+	}
+}
+
+// stsCheck passes if STS accepts the instance profile credentials within the
+// timeout.
+func stsCheck(awsSts *lazySTSClient, timeout time.Duration) func() error {
+	return func() error {
+		client, err := awsSts.Client()
+
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		// The SDK does not keep the context of a request when it retries, so
+		// the check makes a single attempt
+		req, _ := client.GetCallerIdentityRequest(&sts.GetCallerIdentityInput{})
+		req.Retryer = awsclient.DefaultRetryer{NumMaxRetries: 0}
+		req.HTTPRequest = req.HTTPRequest.WithContext(ctx)
+		return req.Send()
+	}
+}
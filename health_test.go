@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadiness(t *testing.T) {
+	assert := assert.New(t)
+
+	ready := newReadiness(time.Hour)
+	calls := 0
+	var checkErr error
+
+	ready.Add("container-backend", containerBackendCheck(testContainerService{}))
+	ready.Add("dependency", func() error {
+		calls++
+		return checkErr
+	})
+
+	admin := newAdminHandler(testContainerService{}, nil, "0123456789abcdef", nil)
+	admin.HandlePublic(healthzPath, ready.HandleHealth)
+	admin.HandlePublic(readyzPath, ready.HandleReady)
+
+	// Health checks do not require the admin token
+	w := testRequest(admin.ServeHTTP, "GET", healthzPath, "")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(http.StatusUnauthorized, testRequest(admin.ServeHTTP, "GET", adminConfigPath, "").Code)
+
+	w = testRequest(admin.ServeHTTP, "GET", readyzPath, "")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`{"container-backend":"ok","dependency":"ok"}`, w.Body.String())
+
+	// Results are cached
+	checkErr = errors.New("Unavailable")
+	assert.Equal(http.StatusOK, testRequest(admin.ServeHTTP, "GET", readyzPath, "").Code)
+	assert.Equal(1, calls)
+
+	ready.ttl = 0
+	w = testRequest(admin.ServeHTTP, "GET", readyzPath, "")
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	assert.Equal(`{"container-backend":"ok","dependency":"Unavailable"}`, w.Body.String())
+
+	checkErr = nil
+	assert.Equal(http.StatusOK, testRequest(admin.ServeHTTP, "GET", readyzPath, "").Code)
+
+	ready.ShuttingDown()
+	w = testRequest(admin.ServeHTTP, "GET", readyzPath, "")
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	assert.Contains(w.Body.String(), `"shutdown":"Shutting down"`)
+	assert.Equal(http.StatusOK, testRequest(admin.ServeHTTP, "GET", healthzPath, "").Code)
+}
+
+func TestReadinessChecksRunWithoutLock(t *testing.T) {
+	assert := assert.New(t)
+
+	ready := newReadiness(time.Hour)
+	started := make(chan bool)
+	release := make(chan bool)
+
+	ready.Add("slow", func() error {
+		started <- true
+		<-release
+		return nil
+	})
+
+	done := make(chan bool)
+	go func() {
+		_, isReady := ready.Check()
+		done <- isReady
+	}()
+	<-started
+
+	// Other probes are not blocked by the running check and get the
+	// previous result
+	results, isReady := ready.Check()
+	assert.False(isReady)
+	assert.Equal(errNotChecked, results["slow"])
+	ready.ShuttingDown()
+
+	// The probe that was running before the shutdown still reports ready
+	close(release)
+	assert.True(<-done)
+
+	results, _ = ready.Check()
+	assert.Nil(results["slow"])
+}
+
+func TestMetadataServiceCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	status := http.StatusOK
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(http.MethodHead, r.Method)
+		assert.Equal("/latest/meta-data/", r.URL.Path)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	check := metadataServiceCheck(server.URL, &http.Transport{})
+	assert.Nil(check())
+
+	// Every check makes a request
+	status = http.StatusUnauthorized
+	assert.Nil(check())
+	assert.Equal(2, requests)
+
+	status = http.StatusInternalServerError
+	assert.NotNil(check())
+
+	server.Close()
+	assert.NotNil(check())
+}
+
+func TestSTSCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	release := make(chan struct{})
+	slow := false
+	awsSts := newFakeSTS(t, func(form map[string]string, accessKey string) error {
+		assert.Equal("GetCallerIdentity", form["Action"])
+
+		if slow {
+			<-release
+		}
+
+		return nil
+	})
+	t.Cleanup(func() { close(release) })
+
+	check := stsCheck(newLazySTSClient(func() (*sts.STS, error) { return awsSts, nil }), 100*time.Millisecond)
+	assert.Nil(check())
+
+	// A check that does not get a response in time fails
+	slow = true
+	start := time.Now()
+	assert.NotNil(check())
+	assert.True(time.Since(start) < time.Second, "%s", time.Since(start))
+}
+
+func TestLivenessCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	platform := &syncedContainerService{testContainerService: testContainerService{}}
+	loops := &serveLoops{}
+	alive := livenessCheck(platform, loops)
+	assert.NotNil(alive())
+
+	platform.synced = true
+	assert.Nil(alive())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+
+	server := &http.Server{Handler: http.NotFoundHandler()}
+	errs := make(chan error, 1)
+	loops.Go(server, listener, errs)
+	assert.Nil(alive())
+
+	// The watchdog stops once a server stopped
+	listener.Close()
+	assert.NotNil(<-errs)
+	assert.NotNil(alive())
+}
+
+type syncedContainerService struct {
+	testContainerService
+	synced bool
+}
+
+func (s *syncedContainerService) Synced() bool {
+	return s.synced
+}
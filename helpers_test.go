@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"time"
+)
+
+type testContainerService map[string]containerInfo
+
+func (t testContainerService) ContainerForIP(containerIP string) (containerInfo, error) {
+	if info, found := t[containerIP]; found {
+		return info, nil
+	}
+
+	return containerInfo{}, fmt.Errorf("No container found for IP %s", containerIP)
+}
+
+func (t testContainerService) Containers() []containerInfo {
+	var containers []containerInfo
+
+	for ip, info := range t {
+		info.IPAddress = ip
+		containers = append(containers, info)
+	}
+
+	sort.Slice(containers, func(i, j int) bool { return containers[i].IPAddress < containers[j].IPAddress })
+	return containers
+}
+
+func (t testContainerService) Sync() {
+}
+
+func (t testContainerService) Synced() bool {
+	return true
+}
+
+func (t testContainerService) TypeName() string {
+	return "test"
+}
+
+// newTestConfig returns the configuration with the default values of the
+// reloadable flags.
+func newTestConfig() *liveConfig {
+	return newLiveConfig(reloadableConfig{
+		NoRoleBehavior:       noRoleNone,
+		SessionDuration:      time.Hour,
+		Overrides:            &metadataOverrides{},
+		MetadataDeniedStatus: http.StatusNotFound,
+	})
+}
+
+// testConfigure applies a copy of the configuration that is changed by update.
+func testConfigure(config *liveConfig, update func(cfg *reloadableConfig)) {
+	cfg := *config.Load()
+	update(&cfg)
+	config.Store(cfg)
+}
+
+func newTestCredentialsProvider(platform containerService) *credentialsProvider {
+	config := newTestConfig()
+	testConfigure(config, func(cfg *reloadableConfig) {
+		cfg.DefaultIamRole, _ = newRoleArn("arn:aws:iam::123456789012:role/test-role-name")
+	})
+
+	sources := map[string]credentialSource{"static": newStaticCredentialSource("AKID", "SECRET", "TOKEN")}
+	return newCredentialsProvider(platform, sources, "static", config, nil)
+}
+
+// testRequest sends a request to the handler and returns the response. The
+// request comes from ip, unless it is empty, and has the headers, which are
+// given as "Name: value".
+func testRequest(handler http.HandlerFunc, method, path, ip string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+
+	if len(ip) > 0 {
+		r.RemoteAddr = ip + ":12345"
+	}
+
+	for _, header := range headers {
+		parts := strings.SplitN(header, ":", 2)
+		r.Header.Set(parts[0], strings.TrimSpace(parts[1]))
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
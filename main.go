@@ -1,26 +1,42 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/alecthomas/kingpin"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
 	log "github.com/cihub/seelog"
 )
 
 var (
 	credsRegex = regexp.MustCompile("^/(.+?)/meta-data/iam/security-credentials/(.*)$")
 
-	instanceServiceClient = &http.Transport{}
+	webIdentityTokenRegex = regexp.MustCompile("^/(.+?)/meta-data/iam/web-identity-token$")
 
-	client = &http.Client{}
+	instanceServiceClient http.RoundTripper = &http.Transport{}
+
+	// Token for the requests the proxy makes to the metadata service
+	metadataToken           string
+	metadataTokenExpiration time.Time
+	metadataTokenLock       sync.Mutex
+)
+
+const (
+	metadataTokenTTL = 5 * time.Minute
 )
 
 var (
@@ -33,6 +49,273 @@ var (
 				Default("").
 				String()
 
+	defaultRoleAccount = kingpin.
+				Flag("default-role-account", "Account of roles that containers give by name (IAM_ROLE=my-app) instead of ARN. Defaults to the account of the EC2 instance.").
+				Default("").
+				String()
+
+	allowedRoles = kingpin.
+			Flag("allowed-role", "Glob pattern of the role ARNs that containers can use, e.g. arn:aws:iam::123456789012:role/app-*. Can be repeated. All roles are allowed if not set.").
+			Strings()
+
+	noRoleBehavior = kingpin.
+			Flag("no-role-behavior", "Behavior for containers without a role if there is no default role: none (no credentials, like an instance without an instance profile) or instance-profile (the credentials of the instance profile, requires --allow-instance-profile).").
+			Default("none").
+			Enum("none", "instance-profile")
+
+	allowInstanceProfile = kingpin.
+				Flag("allow-instance-profile", "Allow containers to use the credentials of the instance profile with IAM_ROLE=:instance-profile or an override rule.").
+				Bool()
+
+	shareCredentials = kingpin.
+				Flag("share-credentials", "Share credentials between containers that use the same role and policy instead of assuming the role for each container.").
+				Bool()
+
+	sessionDuration = kingpin.
+			Flag("session-duration", "Duration of the role sessions created for containers, between 15m and 12h. Sessions of containers with a role chain last at most 1h.").
+			Default("1h").
+			Duration()
+
+	stsMaxAttempts = kingpin.
+			Flag("sts-max-attempts", "Maximum number of attempts for a STS request that fails with a throttling or server error.").
+			Default("3").
+			Int()
+
+	stsCircuitBreakerThreshold = kingpin.
+					Flag("sts-circuit-breaker-threshold", "Number of consecutive failed STS requests for a role before requests for the role are suspended. 0 disables the circuit breaker.").
+					Default("5").
+					Int()
+
+	stsCircuitBreakerCooldown = kingpin.
+					Flag("sts-circuit-breaker-cooldown", "How long requests for a role are suspended when the circuit breaker opens.").
+					Default("30s").
+					Duration()
+
+	stsNegativeCacheTTL = kingpin.
+				Flag("sts-negative-cache-ttl", "How long to cache STS errors that will not succeed when retried, such as AccessDenied.").
+				Default("30s").
+				Duration()
+
+	stsRegion = kingpin.
+			Flag("sts-region", "Region of the STS endpoint. Defaults to the region of the EC2 instance.").
+			Default("").
+			String()
+
+	stsEndpointURL = kingpin.
+			Flag("sts-endpoint", "URL of the STS endpoint, such as a VPC interface endpoint. Defaults to the regional STS endpoint.").
+			Default("").
+			String()
+
+	stsFIPS = kingpin.
+		Flag("sts-fips", "Use the FIPS STS endpoint for the region. Can not be used with --sts-endpoint.").
+		Bool()
+
+	stsCABundle = kingpin.
+			Flag("sts-ca-bundle", "File with PEM encoded certificates to trust when connecting to STS.").
+			Default("").
+			String()
+
+	credentialSourceName = kingpin.
+				Flag("credential-source", "Default source of container credentials (sts, vault, process, static). Containers can select another configured source with IAM_CREDENTIAL_SOURCE.").
+				Default("sts").
+				Enum("sts", "vault", "process", "static", "webidentity")
+
+	vaultAddr = kingpin.
+			Flag("vault-addr", "Address of the Vault server for the vault credential source.").
+			Default("").
+			String()
+
+	vaultTokenFile = kingpin.
+			Flag("vault-token-file", "File containing the Vault token. Defaults to the VAULT_TOKEN environment variable.").
+			Default("").
+			String()
+
+	vaultAwsMount = kingpin.
+			Flag("vault-aws-mount", "Path of the Vault AWS secrets engine.").
+			Default("aws").
+			String()
+
+	vaultAwsRole = kingpin.
+			Flag("vault-aws-role", "Vault AWS secrets engine role to use if the container does not specify one with VAULT_AWS_ROLE.").
+			Default("").
+			String()
+
+	vaultCABundle = kingpin.
+			Flag("vault-ca-bundle", "File with PEM encoded certificates to trust when connecting to Vault.").
+			Default("").
+			String()
+
+	credentialProcess = kingpin.
+				Flag("credential-process", "Command that prints credentials in the credential_process format for the process credential source.").
+				Default("").
+				String()
+
+	credentialProcessTimeout = kingpin.
+					Flag("credential-process-timeout", "Maximum time the credential process may run.").
+					Default("30s").
+					Duration()
+
+	staticAccessKeyID = kingpin.
+				Flag("static-access-key-id", "Access key id for the static credential source (testing only).").
+				Default("").
+				String()
+
+	staticSecretAccessKey = kingpin.
+				Flag("static-secret-access-key", "Secret access key for the static credential source (testing only).").
+				Default("").
+				String()
+
+	staticSessionToken = kingpin.
+				Flag("static-session-token", "Session token for the static credential source (testing only).").
+				Default("").
+				String()
+
+	oidcIssuerURL = kingpin.
+			Flag("oidc-issuer-url", "HTTPS URL of the OIDC issuer. Enables signing tokens that identify containers and the webidentity credential source.").
+			Default("").
+			String()
+
+	oidcSigningKey = kingpin.
+			Flag("oidc-signing-key", "File with the PEM encoded RSA private key used to sign OIDC tokens.").
+			Default("").
+			String()
+
+	oidcAudience = kingpin.
+			Flag("oidc-audience", "Audience of the OIDC tokens.").
+			Default("sts.amazonaws.com").
+			String()
+
+	oidcSubjectTemplate = kingpin.
+				Flag("oidc-subject", "Template for the subject of the OIDC tokens. Fields: .Platform, .ID, .Name, .Image and .Labels.").
+				Default("{{.Platform}}:{{.Image}}:{{.Name}}").
+				String()
+
+	oidcTokenTTL = kingpin.
+			Flag("oidc-token-ttl", "Lifetime of the OIDC tokens.").
+			Default("1h").
+			Duration()
+
+	ecsCredentialsEndpoint = kingpin.
+				Flag("ecs-credentials", "Serve the ECS container credentials endpoint (AWS_CONTAINER_CREDENTIALS_RELATIVE_URI).").
+				Bool()
+
+	ecsTaskMetadataEndpoint = kingpin.
+				Flag("ecs-task-metadata", "Serve the ECS task metadata endpoint (ECS_CONTAINER_METADATA_URI_V4). Only supported for docker.").
+				Bool()
+
+	ecsCluster = kingpin.
+			Flag("ecs-cluster", "Cluster name reported by the ECS task metadata endpoint.").
+			Default("default").
+			String()
+
+	podIdentityEndpoint = kingpin.
+				Flag("eks-pod-identity", "Serve the EKS Pod Identity agent credentials endpoint (/v1/credentials).").
+				Bool()
+
+	podIdentityAuth = kingpin.
+			Flag("eks-pod-identity-auth", "How callers of the EKS Pod Identity endpoint are authenticated: token (container authorization token and source IP) or ip (source IP only).").
+			Default("token").
+			Enum("token", "ip")
+
+	metadataOverridesFile = kingpin.
+				Flag("metadata-overrides-file", "JSON file with rules that override metadata values for matching containers.").
+				Default("").
+				String()
+
+	metadataDialTimeout = kingpin.
+				Flag("metadata-dial-timeout", "Timeout for connecting to the EC2 metadata service.").
+				Default("1s").
+				Duration()
+
+	metadataResponseTimeout = kingpin.
+				Flag("metadata-response-timeout", "Timeout for the response headers of the EC2 metadata service.").
+				Default("2s").
+				Duration()
+
+	metadataTimeout = kingpin.
+			Flag("metadata-timeout", "Timeout for a request to the EC2 metadata service, including retries and the response body.").
+			Default("5s").
+			Duration()
+
+	metadataAttemptTimeout = kingpin.
+				Flag("metadata-attempt-timeout", "Timeout for each attempt of a request to the EC2 metadata service, including the response body.").
+				Default("2s").
+				Duration()
+
+	metadataMaxAttempts = kingpin.
+				Flag("metadata-max-attempts", "Maximum number of attempts for a GET request to the EC2 metadata service that fails with an error or a server error.").
+				Default("3").
+				Int()
+
+	metadataMaxIdleConns = kingpin.
+				Flag("metadata-max-idle-conns", "Maximum number of idle keep-alive connections to the EC2 metadata service.").
+				Default("16").
+				Int()
+
+	metadataIdleConnTimeout = kingpin.
+				Flag("metadata-idle-conn-timeout", "How long idle keep-alive connections to the EC2 metadata service are kept open.").
+				Default("90s").
+				Duration()
+
+	tokenHopLimit = kingpin.
+			Flag("token-hop-limit", "IP TTL of the IMDSv2 token responses, like the instance metadata option HttpPutResponseHopLimit. Containers that are more hops away than the limit do not receive the token. 0 uses the system default.").
+			Default("0").
+			Int()
+
+	metadataAllow = kingpin.
+			Flag("metadata-allow", "Metadata path that containers can read, relative to meta-data. A trailing * matches any path with the prefix. Can be repeated.").
+			Strings()
+
+	metadataDeny = kingpin.
+			Flag("metadata-deny", "Metadata path that containers can not read, relative to meta-data. A trailing * matches any path with the prefix. Can be repeated.").
+			Strings()
+
+	metadataDeniedStatus = kingpin.
+				Flag("metadata-denied-status", "HTTP status of the response for denied metadata paths.").
+				Default("404").
+				Enum("403", "404")
+
+	metadataCacheEnabled = kingpin.
+				Flag("metadata-cache", "Cache responses of the EC2 metadata service for paths that do not change, such as instance-id and placement.").
+				Bool()
+
+	metadataCacheTTLs = kingpin.
+				Flag("metadata-cache-ttl", "Cache TTL of a metadata path (PATH=DURATION), relative to meta-data. A trailing * matches any path with the prefix. A TTL of 0 disables caching of the path. Can be repeated.").
+				StringMap()
+
+	metadataSnapshotEnabled = kingpin.
+				Flag("metadata-snapshot", "Serve the last known values of static metadata paths when the EC2 metadata service is unavailable.").
+				Bool()
+
+	metadataSnapshotFile = kingpin.
+				Flag("metadata-snapshot-file", "File to persist the metadata snapshot to, so it is available when the proxy restarts. Implies --metadata-snapshot.").
+				Default("").
+				String()
+
+	containerNetworkIdentity = kingpin.
+					Flag("container-network-identity", "Serve the IP address, hostname and MAC address of the container for local-ipv4, local-hostname, hostname, mac and network/interfaces/macs.").
+					Bool()
+
+	containerTokenDir = kingpin.
+				Flag("container-token-dir", "Directory to write the ECS and EKS Pod Identity environment of each container to, in <dir>/<container name>/env and <dir>/<container name>/token. Mount the container's directory into the container to give it its authorization token. Required with --ecs-credentials, --ecs-task-metadata and --eks-pod-identity-auth=token.").
+				Default("").
+				String()
+
+	containerTokenSecretFile = kingpin.
+					Flag("container-token-secret-file", "File with the secret used to derive per-container authorization tokens. Defaults to a random secret, so tokens change when the proxy restarts.").
+					Default("").
+					String()
+
+	iamPolicyDir = kingpin.
+			Flag("iam-policy-dir", "Directory of named IAM policies (<name>.json) that containers can reference with IAM_POLICY_NAME.").
+			Default("").
+			String()
+
+	iamPolicyReloadInterval = kingpin.
+				Flag("iam-policy-reload-interval", "How often to check the IAM policy directory for changes.").
+				Default("10s").
+				Duration()
+
 	metadataURL = kingpin.
 			Flag("metadata-url", "URL of the real EC2 metadata service.").
 			Default("http://169.254.169.254").
@@ -44,6 +327,31 @@ var (
 			Short('s').
 			String()
 
+	adminServerAddr = kingpin.
+			Flag("admin-server", "Interface and port, or unix:<path> for a unix socket, to bind the admin API to. The admin API is disabled if not set.").
+			Default("").
+			String()
+
+	adminTokenFile = kingpin.
+			Flag("admin-token-file", "File with the bearer token required by the admin API. Required unless the admin API uses a unix socket.").
+			Default("").
+			String()
+
+	configFile = kingpin.
+			Flag("config-file", "JSON file with flag values by flag name. Flags given on the command line or in EC2METAPROXY_<FLAG> environment variables take precedence. The file is reloaded on SIGHUP and when it changes.").
+			Default("").
+			String()
+
+	configReloadInterval = kingpin.
+				Flag("config-reload-interval", "How often to check the configuration file for changes. 0 only reloads the file on SIGHUP.").
+				Default("10s").
+				Duration()
+
+	shutdownTimeout = kingpin.
+			Flag("shutdown-timeout", "How long active requests are drained on SIGTERM before the proxy exits.").
+			Default("30s").
+			Duration()
+
 	verbose = kingpin.
 		Flag("verbose", "Enable verbose output.").
 		Bool()
@@ -52,15 +360,45 @@ var (
 
 	dockerEndpoint = dockerCommand.
 			Flag("docker-endpoint", "Endpoint to communicate with the docker daemon.").
-			Default("unix:///var/run/docker.sock").
+			Default(defaultDockerEndpoint).
 			String()
 
 	flynnCommand = kingpin.Command("flynn", "Run proxy for flynn container manager.")
 
 	flynnEndpoint = flynnCommand.
 			Flag("flynn-endpoint", "Endpoint to communicate with the flynn host.").
-			Default("http://127.0.0.1:1113").
+			Default(defaultFlynnEndpoint).
+			String()
+
+	explainCommand = kingpin.Command("explain", "Explain how the proxy resolves the role and policy of a container, without requesting credentials.")
+
+	explainPlatform = explainCommand.
+			Flag("platform", "Container manager of the container: docker or flynn.").
+			Default("docker").
+			Enum("docker", "flynn")
+
+	explainEndpoint = explainCommand.
+			Flag("endpoint", "Endpoint to communicate with the docker daemon or flynn host. Defaults to the default endpoint of the platform.").
+			Default("").
+			String()
+
+	explainIP = explainCommand.
+			Flag("ip", "IP address of the container.").
+			Default("").
 			String()
+
+	explainAssume = explainCommand.
+			Flag("assume", "Request credentials for the roles of the container to test them.").
+			Bool()
+
+	explainContainerRef = explainCommand.
+				Arg("container", "ID, ID prefix or name of the container, if --ip is not given.").
+				String()
+)
+
+const (
+	defaultDockerEndpoint = "unix:///var/run/docker.sock"
+	defaultFlynnEndpoint  = "http://127.0.0.1:1113"
 )
 
 type metadataCredentials struct {
@@ -73,6 +411,21 @@ type metadataCredentials struct {
 	Expiration      time.Time
 }
 
+// Headers that apply to a single connection and must not be forwarded by a proxy
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// copyHeaders replaces the headers in dst with the headers in src, except for
+// the hop-by-hop headers and the headers listed in the Connection header.
 func copyHeaders(dst, src http.Header) {
 	for k := range dst {
 		dst.Del(k)
@@ -83,6 +436,16 @@ func copyHeaders(dst, src http.Header) {
 		copy(vCopy, v)
 		dst[k] = vCopy
 	}
+
+	for _, connection := range src["Connection"] {
+		for _, k := range strings.Split(connection, ",") {
+			dst.Del(strings.TrimSpace(k))
+		}
+	}
+
+	for _, k := range hopByHopHeaders {
+		dst.Del(k)
+	}
 }
 
 func configureLogging(verbose bool) {
@@ -157,46 +520,120 @@ func logHandler(handler func(w http.ResponseWriter, r *http.Request)) func(w htt
 	}
 }
 
+// fetchMetadataToken returns an IMDSv2 token for the requests the proxy makes
+// itself. Tokens are reused until shortly before they expire.
 func fetchMetadataToken() (string, error) {
-	var token = ""
-	req, err := http.NewRequest(http.MethodPut, "http://169.254.169.254/latest/api/token", nil)
+	metadataTokenLock.Lock()
+	defer metadataTokenLock.Unlock()
+
+	if len(metadataToken) > 0 && time.Now().Add(time.Minute).Before(metadataTokenExpiration) {
+		return metadataToken, nil
+	}
+
+	req, err := http.NewRequest(http.MethodPut, *metadataURL+"/latest/api/token", nil)
+
 	if err != nil {
-		log.Error("Error making request for fetching metadata token: ", err)
 		return "", err
 	}
-	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
-	resp, err := client.Do(req)
-	if resp.StatusCode == http.StatusOK {
-		bodyBytes, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Error("Error reading response body from fetching metadata token: ", err)
-		}
-		token = string(bodyBytes)
+
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(int(metadataTokenTTL/time.Second)))
+	expiration := time.Now().Add(metadataTokenTTL)
+	resp, err := instanceServiceClient.RoundTrip(req)
+
+	if err != nil {
+		return "", err
 	}
+
 	defer resp.Body.Close()
-	return token, err
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Error fetching token from metadata service: %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return "", err
+	}
+
+	metadataToken = string(body)
+	metadataTokenExpiration = expiration
+	return metadataToken, nil
 }
 
-func newGET(path string) *http.Request {
+func newGET(path string) (*http.Request, error) {
 	token, err := fetchMetadataToken()
+
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+
 	r, err := http.NewRequest("GET", path, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
 	r.Header.Set("X-aws-ec2-metadata-token", token)
+	return r, nil
+}
+
+func fetchMetadata(path string) (string, error) {
+	req, err := newGET(*metadataURL + path)
+
 	if err != nil {
-		panic(err)
+		return "", err
+	}
+
+	resp, err := instanceServiceClient.RoundTrip(req)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Error fetching %s from metadata service: %s", path, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+type instanceIdentityDocument struct {
+	AccountID        string `json:"accountId"`
+	AvailabilityZone string `json:"availabilityZone"`
+	InstanceID       string `json:"instanceId"`
+	Region           string `json:"region"`
+}
+
+func fetchInstanceIdentity() (instanceIdentityDocument, error) {
+	var document instanceIdentityDocument
+	data, err := fetchMetadata("/latest/dynamic/instance-identity/document")
+
+	if err != nil {
+		return document, err
 	}
 
-	return r
+	err = json.Unmarshal([]byte(data), &document)
+	return document, err
 }
 
-func handleCredentials(baseURL, apiVersion, subpath string, c *credentialsProvider, w http.ResponseWriter, r *http.Request) {
-	resp, err := instanceServiceClient.RoundTrip(newGET(baseURL + "/" + apiVersion + "/meta-data/iam/security-credentials/"))
+func handleCredentials(baseURL, apiVersion, subpath string, c *credentialsProvider, proxy *metadataProxy, w http.ResponseWriter, r *http.Request) {
+	req, err := newGET(baseURL + "/" + apiVersion + "/meta-data/iam/security-credentials/")
 
 	if err != nil {
 		log.Error("Error requesting creds path for API version ", apiVersion, ": ", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeUpstreamError(w, err)
+		return
+	}
+
+	resp, err := instanceServiceClient.RoundTrip(req)
+
+	if err != nil {
+		log.Error("Error requesting creds path for API version ", apiVersion, ": ", err)
+		writeUpstreamError(w, err)
 		return
 	}
 
@@ -208,104 +645,547 @@ func handleCredentials(baseURL, apiVersion, subpath string, c *credentialsProvid
 	}
 
 	clientIP := remoteIP(r.RemoteAddr)
-	credentials, err := c.CredentialsForIP(clientIP)
+
+	if len(subpath) == 0 {
+		roleNames, err := c.RoleNamesForIP(clientIP)
+
+		if !handleCredentialsError(clientIP, err, proxy, w, r) {
+			w.Write([]byte(strings.Join(roleNames, "\n")))
+		}
+
+		return
+	}
+
+	// An idiosyncrasy of the standard EC2 metadata service:
+	// Subpaths of the role name are ignored. So long as the correct role name is provided,
+	// it can be followed by a slash and anything after the slash is ignored.
+	roleName := subpath
+
+	if index := strings.Index(subpath, "/"); index >= 0 {
+		roleName = subpath[:index]
+	}
+
+	credentials, err := c.CredentialsForRole(clientIP, roleName)
+
+	if err == errUnknownRole {
+		writeIMDSError(w, http.StatusNotFound)
+		return
+	}
+
+	if handleCredentialsError(clientIP, err, proxy, w, r) {
+		return
+	}
+
+	creds, err := json.Marshal(&metadataCredentials{
+		Code:            "Success",
+		LastUpdated:     credentials.GeneratedAt,
+		Type:            "AWS-HMAC",
+		AccessKeyID:     credentials.AccessKey,
+		SecretAccessKey: credentials.SecretKey,
+		Token:           credentials.Token,
+		Expiration:      credentials.Expiration,
+	})
 
 	if err != nil {
+		log.Error("Error marshaling credentials: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		w.Write(creds)
+	}
+}
+
+// handleCredentialsError writes the response for an error getting container
+// credentials. Returns false if there is no error.
+func handleCredentialsError(clientIP string, err error, proxy *metadataProxy, w http.ResponseWriter, r *http.Request) bool {
+	switch {
+	case err == nil:
+		return false
+	case err == errNoCredentials:
+		// Like an instance without an instance profile
+		writeIMDSError(w, http.StatusNotFound)
+	case err == errInstanceProfile:
+		proxy.proxy(w, r)
+	default:
 		log.Error(clientIP, " ", err)
 		http.Error(w, "An unexpected error getting container role", http.StatusInternalServerError)
+	}
+
+	return true
+}
+
+// newRoleNameDefaults returns the account and partition to expand role names.
+// The account defaults to the account of the instance and the partition is
+// the partition of the instance region.
+func newRoleNameDefaults(accountID string) roleNameDefaults {
+	defaults := roleNameDefaults{AccountID: accountID, Partition: "aws"}
+	identity, err := fetchInstanceIdentity()
+
+	if err != nil {
+		log.Warn("Unable to get the instance account and region for role names: ", err)
+		return defaults
+	}
+
+	if len(defaults.AccountID) == 0 {
+		defaults.AccountID = identity.AccountID
+	}
+
+	defaults.Partition = regionPartition(identity.Region)
+	return defaults
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	data, err := json.Marshal(value)
+
+	if err != nil {
+		log.Error("Error marshaling JSON response: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	roleName := credentials.RoleArn.RoleName()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
 
-	if len(subpath) == 0 {
-		w.Write([]byte(roleName))
-	} else if !strings.HasPrefix(subpath, roleName) || (len(subpath) > len(roleName) && subpath[len(roleName)-1] != '/') {
-		// An idiosyncrasy of the standard EC2 metadata service:
-		// Subpaths of the role name are ignored. So long as the correct role name is provided,
-		// it can be followed by a slash and anything after the slash is ignored.
-		w.WriteHeader(http.StatusNotFound)
-	} else {
-		creds, err := json.Marshal(&metadataCredentials{
-			Code:            "Success",
-			LastUpdated:     credentials.GeneratedAt,
-			Type:            "AWS-HMAC",
-			AccessKeyID:     credentials.AccessKey,
-			SecretAccessKey: credentials.SecretKey,
-			Token:           credentials.Token,
-			Expiration:      credentials.Expiration,
-		})
+// effectiveConfig returns the values of the global flags and the flags of the
+// command, except for secrets. The reloadable flags have the values of the
+// applied configuration.
+func effectiveConfig(command string, config *liveConfig) map[string]interface{} {
+	model := kingpin.CommandLine.Model()
+	flags := make(map[string]string)
 
-		if err != nil {
-			log.Error("Error marshaling credentials: ", err)
-			w.WriteHeader(http.StatusInternalServerError)
-		} else {
-			w.Write(creds)
+	addFlags := func(group *kingpin.FlagGroupModel) {
+		for _, flag := range group.Flags {
+			if flag.Name == "help" {
+				continue
+			}
+
+			value := flag.Value.String()
+
+			if values, found := config.Load().Flags[flag.Name]; found {
+				if isCumulative(flag) {
+					value = strings.Join(values, ",")
+				} else if len(values) > 0 {
+					value = values[len(values)-1]
+				} else {
+					value = ""
+				}
+			}
+
+			if secretFlags[flag.Name] && len(value) > 0 {
+				flags[flag.Name] = "REDACTED"
+			} else {
+				flags[flag.Name] = value
+			}
+		}
+	}
+
+	addFlags(model.FlagGroupModel)
+
+	for _, cmd := range model.Commands {
+		if cmd.Name == command {
+			addFlags(cmd.FlagGroupModel)
 		}
 	}
+
+	return map[string]interface{}{
+		"command":       command,
+		"flags":         flags,
+		"role_defaults": roleDefaults,
+	}
 }
 
-func newContainerService(platform string) (containerService, error) {
+func newContainerService(platform, endpoint string) (containerService, error) {
 	switch platform {
 	case "docker":
-		return newDockerContainerService(*dockerEndpoint)
+		if len(endpoint) == 0 {
+			endpoint = defaultDockerEndpoint
+		}
+
+		return newDockerContainerService(endpoint)
 	case "flynn":
-		return newFlynnContainerService(*flynnEndpoint)
+		if len(endpoint) == 0 {
+			endpoint = defaultFlynnEndpoint
+		}
+
+		return newFlynnContainerService(endpoint)
 	default:
 		return nil, fmt.Errorf("Unknown container platform: %s", platform)
 	}
 }
 
+func newCredentialSources(awsSts *lazySTSClient, failures *failureTracker, issuer *oidcIssuer) (map[string]credentialSource, error) {
+	sources := map[string]credentialSource{
+		"sts": newSTSCredentialSource(awsSts, failures),
+	}
+
+	if issuer != nil {
+		sources["webidentity"] = newWebIdentityCredentialSource(awsSts, issuer, failures)
+	}
+
+	if len(*vaultAddr) > 0 {
+		client := &http.Client{}
+
+		if len(*vaultCABundle) > 0 {
+			var err error
+
+			if client, err = newCABundleClient(*vaultCABundle); err != nil {
+				return nil, err
+			}
+		}
+
+		sources["vault"] = newVaultCredentialSource(*vaultAddr, *vaultTokenFile, *vaultAwsMount, *vaultAwsRole, client)
+	}
+
+	if len(*credentialProcess) > 0 {
+		sources["process"] = newProcessCredentialSource(*credentialProcess, *credentialProcessTimeout)
+	}
+
+	if len(*staticAccessKeyID) > 0 {
+		sources["static"] = newStaticCredentialSource(*staticAccessKeyID, *staticSecretAccessKey, *staticSessionToken)
+	}
+
+	if _, found := sources[*credentialSourceName]; !found {
+		return nil, fmt.Errorf("Default credential source %s is not configured", *credentialSourceName)
+	}
+
+	return sources, nil
+}
+
+func newSTSClientFromFlags() (*sts.STS, error) {
+	return newSTSClient(session.New(), stsOptions{
+		Region:   *stsRegion,
+		Endpoint: *stsEndpointURL,
+		FIPS:     *stsFIPS,
+		CABundle: *stsCABundle,
+	})
+}
+
+// usesSTS returns true if the credential source assumes roles with STS.
+func usesSTS(sourceName string) bool {
+	return sourceName == "sts" || sourceName == "webidentity"
+}
+
+// newCredentialsProviderFromFlags creates the credentials provider and the
+// resources it depends on from the flags.
+func newCredentialsProviderFromFlags(platform containerService, awsSts *lazySTSClient, issuer *oidcIssuer, config *liveConfig) (*credentialsProvider, error) {
+	policies, err := newPolicyStore(*iamPolicyDir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if *stsMaxAttempts < 1 {
+		return nil, fmt.Errorf("Invalid value for sts-max-attempts: %d, must be at least 1", *stsMaxAttempts)
+	}
+
+	failures := newFailureTracker()
+	failures.maxAttempts = *stsMaxAttempts
+	failures.breakerThreshold = *stsCircuitBreakerThreshold
+	failures.breakerCooldown = *stsCircuitBreakerCooldown
+	failures.negativeCacheTTL = *stsNegativeCacheTTL
+
+	sources, err := newCredentialSources(awsSts, failures, issuer)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newCredentialsProvider(platform, sources, *credentialSourceName, config, policies), nil
+}
+
 func main() {
 	kingpin.CommandLine.Help = "Docker container EC2 metadata service."
 	command := kingpin.Parse()
 
+	config, err := newConfigLoader(kingpin.CommandLine, os.Args[1:], command, *configFile)
+
+	if err != nil {
+		panic(err)
+	}
+
 	defer log.Flush()
 	configureLogging(*verbose)
 
-	platform, err := newContainerService(command)
+	instanceServiceClient = newMetadataTransport(metadataTransportOptions{
+		DialTimeout:           *metadataDialTimeout,
+		ResponseHeaderTimeout: *metadataResponseTimeout,
+		Timeout:               *metadataTimeout,
+		AttemptTimeout:        *metadataAttemptTimeout,
+		MaxAttempts:           *metadataMaxAttempts,
+		MaxIdleConns:          *metadataMaxIdleConns,
+		MaxIdleConnsPerHost:   *metadataMaxIdleConns,
+		IdleConnTimeout:       *metadataIdleConnTimeout,
+	})
+
+	roleDefaults = newRoleNameDefaults(*defaultRoleAccount)
+	cfg, err := config.Config()
+
+	if err != nil {
+		panic(err)
+	}
+
+	live := newLiveConfig(cfg)
+
+	if command == explainCommand.FullCommand() {
+		if err := runExplain(live); err != nil {
+			log.Flush()
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	endpoint := *dockerEndpoint
+
+	if command == flynnCommand.FullCommand() {
+		endpoint = *flynnEndpoint
+	}
+
+	platform, err := newContainerService(command, endpoint)
 
 	if err != nil {
 		panic(err)
 	}
 
-	awsSession := session.New()
-	credentials := newCredentialsProvider(awsSession, platform, *defaultIamRole, *defaultIamPolicy)
+	awsSts := newLazySTSClient(newSTSClientFromFlags)
+
+	// Fail early if the default credential source can not work, other
+	// containers may still use STS, which is then created on first use
+	if usesSTS(*credentialSourceName) {
+		if _, err := awsSts.Client(); err != nil {
+			panic(err)
+		}
+	}
+
+	var issuer *oidcIssuer
+
+	if len(*oidcIssuerURL) > 0 {
+		issuer, err = newOIDCIssuer(*oidcIssuerURL, *oidcAudience, *oidcSubjectTemplate, *oidcSigningKey, *oidcTokenTTL)
+
+		if err != nil {
+			panic(err)
+		}
+
+		http.HandleFunc(oidcDiscoveryPath, logHandler(issuer.HandleDiscovery))
+		http.HandleFunc(oidcJWKSPath, logHandler(issuer.HandleJWKS))
+	}
+
+	credentials, err := newCredentialsProviderFromFlags(platform, awsSts, issuer, live)
+
+	if err != nil {
+		panic(err)
+	}
+
+	credentials.policies.Watch(*iamPolicyReloadInterval)
+
+	if *ecsCredentialsEndpoint || *ecsTaskMetadataEndpoint || *podIdentityEndpoint {
+		tokens, err := newContainerTokens(*containerTokenSecretFile)
+
+		if err != nil {
+			panic(err)
+		}
+
+		ecs := newECSHandler(platform, tokens, live)
+
+		if *ecsCredentialsEndpoint {
+			ecs.credentials = credentials
+			http.HandleFunc(ecsCredentialsPath, logHandler(ecs.HandleCredentials))
+		}
+
+		if *ecsTaskMetadataEndpoint {
+			dockerPlatform, ok := platform.(dockerMetadataService)
+
+			if !ok {
+				panic(fmt.Sprintf("ECS task metadata is not supported for %s", platform.TypeName()))
+			}
+
+			ecs.metadata = newECSMetadata(dockerPlatform, *ecsCluster)
+			http.HandleFunc(ecsMetadataPath, logHandler(ecs.HandleMetadata))
+		}
+
+		if *podIdentityEndpoint {
+			ecs.podIdentity = newPodIdentityHandler(platform, tokens, credentials, live, *podIdentityAuth == "token")
+			http.HandleFunc(podIdentityCredentialsPath, logHandler(ecs.podIdentity.HandleCredentials))
+		}
+
+		if len(*containerTokenDir) > 0 {
+			files, err := newContainerTokenFiles(*containerTokenDir, platform, tokens)
+
+			if err != nil {
+				panic(err)
+			}
+
+			files.credentials = *ecsCredentialsEndpoint
+			files.podIdentity = *podIdentityEndpoint
+			files.metadata = *ecsTaskMetadataEndpoint
+			files.Watch()
+		} else if *ecsCredentialsEndpoint || *ecsTaskMetadataEndpoint || *podIdentityAuth == "token" {
+			panic("--container-token-dir is required to give containers their ECS and EKS Pod Identity environment")
+		}
+	}
+
+	proxy := newMetadataProxy(*metadataURL, instanceServiceClient, platform, live)
+	proxy.tokenHopLimit = *tokenHopLimit
+
+	if *metadataCacheEnabled {
+		ttls := make(map[string]time.Duration)
+
+		for path, value := range *metadataCacheTTLs {
+			if ttls[path], err = time.ParseDuration(value); err != nil {
+				panic(fmt.Sprintf("Invalid metadata cache TTL for %s: %s", path, err))
+			}
+		}
+
+		proxy.cache = newMetadataCache(ttls)
+	}
+
+	if *metadataSnapshotEnabled || len(*metadataSnapshotFile) > 0 {
+		if proxy.snapshot, err = newMetadataSnapshot(*metadataSnapshotFile); err != nil {
+			panic(err)
+		}
+
+		go proxy.snapshot.Capture(fetchMetadata)
+	}
+
+	config.Watch(*configReloadInterval, func(cfg reloadableConfig) {
+		live.Store(cfg)
+		log.Info("Configuration reloaded")
+	})
 
 	// Proxy non-credentials requests to primary metadata service
 	http.HandleFunc("/", logHandler(func(w http.ResponseWriter, r *http.Request) {
+		if !proxy.Authorize(w, r) {
+			return
+		}
+
 		match := credsRegex.FindStringSubmatch(r.URL.Path)
 		if match != nil {
-			handleCredentials(*metadataURL, match[1], match[2], credentials, w, r)
+			handleCredentials(*metadataURL, match[1], match[2], credentials, proxy, w, r)
+			return
+		}
+
+		if issuer != nil && webIdentityTokenRegex.MatchString(r.URL.Path) {
+			issuer.HandleToken(platform, w, r)
 			return
 		}
 
-		proxyReq, err := http.NewRequest(r.Method, fmt.Sprintf("%s%s", *metadataURL, r.URL.Path), r.Body)
+		proxy.Handle(w, r)
+	}))
+
+	ready := newReadiness(readinessCheckTTL)
+	ready.Add("container-backend", containerBackendCheck(platform))
+	ready.Add("metadata-service", metadataServiceCheck(*metadataURL, instanceServiceClient))
+
+	if usesSTS(*credentialSourceName) {
+		ready.Add("sts", stsCheck(awsSts, stsCheckTimeout))
+	}
+
+	// Synchronize the containers before the first request, so the proxy
+	// becomes ready
+	go platform.Sync()
+
+	listeners, adminListener, err := activatedListeners(sdListenFdsStart)
+
+	if err != nil {
+		panic(err)
+	}
+
+	if len(listeners) == 0 {
+		listener, err := net.Listen("tcp", *serverAddr)
 
 		if err != nil {
-			log.Error("Error creating proxy http request: ", err)
-			http.Error(w, "An unexpected error occurred communicating with Amazon", http.StatusInternalServerError)
-			return
+			panic(err)
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	server := &http.Server{ConnContext: withConn}
+	servers := []*http.Server{server}
+
+	if len(*adminServerAddr) > 0 || adminListener != nil {
+		addr := *adminServerAddr
+
+		if adminListener != nil {
+			addr = activatedAdminAddr(adminListener)
 		}
 
-		copyHeaders(proxyReq.Header, r.Header)
-		resp, err := instanceServiceClient.RoundTrip(proxyReq)
+		token, err := readAdminToken(addr, *adminTokenFile)
 
 		if err != nil {
-			log.Error("Error forwarding request to EC2 metadata service: ", err)
-			http.Error(w, "An unexpected error occurred communicating with Amazon", http.StatusInternalServerError)
-			return
+			panic(err)
 		}
 
-		defer resp.Body.Close()
+		if adminListener == nil {
+			if adminListener, err = listen(addr); err != nil {
+				panic(err)
+			}
+		}
 
-		copyHeaders(w.Header(), resp.Header)
-		w.WriteHeader(resp.StatusCode)
-		if _, err := io.Copy(w, resp.Body); err != nil {
-			log.Warn("Error copying response content from EC2 metadata service: ", err)
+		admin := newAdminHandler(platform, credentials, token, func() interface{} { return effectiveConfig(command, live) })
+		admin.snapshot = proxy.snapshot
+		admin.HandlePublic(healthzPath, ready.HandleHealth)
+		admin.HandlePublic(readyzPath, ready.HandleReady)
+		adminServer := &http.Server{Handler: http.HandlerFunc(logHandler(admin.ServeHTTP))}
+		servers = append(servers, adminServer)
+
+		go func() {
+			log.Info("Admin API listening on ", adminListener.Addr())
+
+			if err := adminServer.Serve(adminListener); err != http.ErrServerClosed {
+				log.Critical(err)
+			}
+		}()
+	}
+
+	stopped := shutdownOnSignal(*shutdownTimeout, ready, servers...)
+	errs := make(chan error, len(listeners))
+	loops := &serveLoops{}
+
+	for _, listener := range listeners {
+		log.Info("Listening on ", listener.Addr())
+		loops.Go(server, listener, errs)
+	}
+
+	go notifySystemd(platform, livenessCheck(platform, loops))
+
+	if err := <-errs; err != http.ErrServerClosed {
+		log.Critical(err)
+		return
+	}
+
+	<-stopped
+	log.Info("Shut down")
+}
+
+// shutdownOnSignal shuts the servers down on SIGTERM or SIGINT. The servers
+// stop accepting connections and the active requests are drained for up to
+// timeout. The returned channel is closed when the servers are shut down.
+func shutdownOnSignal(timeout time.Duration, ready *readiness, servers ...*http.Server) <-chan struct{} {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	stopped := make(chan struct{})
+
+	go func() {
+		sig := <-signals
+		log.Info("Received ", sig, ", draining requests for up to ", timeout)
+		ready.ShuttingDown()
+		sdNotify(sdStopping)
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		// The admin server is last, so it reports the shutdown while requests
+		// are drained
+		for _, server := range servers {
+			if err := server.Shutdown(ctx); err != nil {
+				log.Warn("Error draining requests: ", err)
+			}
 		}
-	}))
 
-	log.Info("Listening on ", *serverAddr)
-	log.Critical(http.ListenAndServe(*serverAddr, nil))
+		close(stopped)
+	}()
+
+	return stopped
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+)
+
+const (
+	macsMetadataPath = "meta-data/network/interfaces/macs"
+)
+
+// networkIdentityValues returns the metadata values that describe the network
+// identity of the container instead of the host.
+func networkIdentityValues(container containerInfo) map[string]string {
+	values := make(map[string]string)
+
+	set := func(path, value string) {
+		if len(value) > 0 {
+			values[path] = value
+		}
+	}
+
+	set("meta-data/local-ipv4", container.IPAddress)
+	set("meta-data/local-hostname", container.Hostname)
+	set("meta-data/hostname", container.Hostname)
+	set("meta-data/mac", container.MacAddress)
+
+	if len(container.MacAddress) > 0 {
+		prefix := macsMetadataPath + "/" + container.MacAddress + "/"
+		set(prefix+"mac", container.MacAddress)
+		set(prefix+"device-number", "0")
+		set(prefix+"local-ipv4s", container.IPAddress)
+		set(prefix+"local-hostname", container.Hostname)
+	}
+
+	return values
+}
+
+// splitMacPath splits a path in the network interfaces tree into the MAC
+// address and the rest of the path.
+func splitMacPath(subpath string) (mac, rest string, ok bool) {
+	if !strings.HasPrefix(subpath, macsMetadataPath+"/") {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(subpath, macsMetadataPath+"/"), "/", 2)
+
+	if len(parts[0]) == 0 {
+		return "", "", false
+	}
+
+	if len(parts) > 1 {
+		rest = "/" + parts[1]
+	}
+
+	return parts[0], rest, true
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+	log "github.com/cihub/seelog"
+)
+
+const (
+	oidcDiscoveryPath = "/.well-known/openid-configuration"
+	oidcJWKSPath      = "/.well-known/jwks.json"
+)
+
+// oidcIssuer signs tokens that identify containers so that IAM trust policies
+// can identify the container instead of the instance profile.
+type oidcIssuer struct {
+	issuerURL string
+	audience  string
+	ttl       time.Duration
+	subject   *template.Template
+	key       *rsa.PrivateKey
+	keyID     string
+}
+
+type oidcSubjectFields struct {
+	Platform string
+	ID       string
+	Name     string
+	Image    string
+	Labels   map[string]string
+}
+
+type oidcClaims struct {
+	Issuer        string            `json:"iss"`
+	Subject       string            `json:"sub"`
+	Audience      string            `json:"aud"`
+	IssuedAt      int64             `json:"iat"`
+	NotBefore     int64             `json:"nbf"`
+	Expiration    int64             `json:"exp"`
+	ContainerID   string            `json:"container_id"`
+	ContainerName string            `json:"container_name"`
+	Image         string            `json:"image,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+}
+
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Modulus   string `json:"n"`
+	Exponent  string `json:"e"`
+}
+
+func newOIDCIssuer(issuerURL, audience, subject, keyFile string, ttl time.Duration) (*oidcIssuer, error) {
+	if !strings.HasPrefix(issuerURL, "https://") {
+		return nil, errors.New("OIDC issuer URL must use https")
+	}
+
+	subjectTemplate, err := template.New("subject").Option("missingkey=zero").Parse(subject)
+
+	if err != nil {
+		return nil, fmt.Errorf("Invalid OIDC subject template: %s", err)
+	}
+
+	key, err := readRSAPrivateKey(keyFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keyHash := sha256.Sum256(publicKey)
+
+	return &oidcIssuer{
+		issuerURL: strings.TrimSuffix(issuerURL, "/"),
+		audience:  audience,
+		ttl:       ttl,
+		subject:   subjectTemplate,
+		key:       key,
+		keyID:     base64.RawURLEncoding.EncodeToString(keyHash[:16]),
+	}, nil
+}
+
+func readRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in %s", path)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing private key %s: %s", path, err)
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+
+	if !ok {
+		return nil, fmt.Errorf("Private key %s is not a RSA key", path)
+	}
+
+	return rsaKey, nil
+}
+
+// Subject returns the subject of the tokens of the container.
+func (o *oidcIssuer) Subject(platform string, container containerInfo) (string, error) {
+	var subject bytes.Buffer
+
+	err := o.subject.Execute(&subject, oidcSubjectFields{
+		Platform: platform,
+		ID:       container.ID,
+		Name:     strings.TrimPrefix(container.Name, "/"),
+		Image:    container.Image,
+		Labels:   container.Labels,
+	})
+
+	return subject.String(), err
+}
+
+// Token returns a signed JWT that identifies the container.
+func (o *oidcIssuer) Token(platform string, container containerInfo) (string, error) {
+	subject, err := o.Subject(platform, container)
+
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": o.keyID,
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(oidcClaims{
+		Issuer:        o.issuerURL,
+		Subject:       subject,
+		Audience:      o.audience,
+		IssuedAt:      now.Unix(),
+		NotBefore:     now.Unix(),
+		Expiration:    now.Add(o.ttl).Unix(),
+		ContainerID:   container.ID,
+		ContainerName: strings.TrimPrefix(container.Name, "/"),
+		Image:         container.Image,
+		Labels:        container.Labels,
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, o.key, crypto.SHA256, digest[:])
+
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (o *oidcIssuer) HandleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"issuer":                                o.issuerURL,
+		"jwks_uri":                              o.issuerURL + oidcJWKSPath,
+		"response_types_supported":              []string{"id_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"claims_supported":                      []string{"iss", "sub", "aud", "iat", "nbf", "exp", "container_id", "container_name", "image", "labels"},
+	})
+}
+
+func (o *oidcIssuer) HandleJWKS(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string][]jsonWebKey{
+		"keys": {{
+			KeyType:   "RSA",
+			Use:       "sig",
+			Algorithm: "RS256",
+			KeyID:     o.keyID,
+			Modulus:   base64.RawURLEncoding.EncodeToString(o.key.PublicKey.N.Bytes()),
+			Exponent:  base64.RawURLEncoding.EncodeToString(big.NewInt(int64(o.key.PublicKey.E)).Bytes()),
+		}},
+	})
+}
+
+// HandleToken returns the token for the container that made the request.
+func (o *oidcIssuer) HandleToken(platform containerService, w http.ResponseWriter, r *http.Request) {
+	clientIP := remoteIP(r.RemoteAddr)
+	container, err := platform.ContainerForIP(clientIP)
+
+	if err != nil {
+		log.Error(clientIP, " ", err)
+		http.Error(w, "An unexpected error getting container identity", http.StatusInternalServerError)
+		return
+	}
+
+	token, err := o.Token(platform.TypeName(), container)
+
+	if err != nil {
+		log.Error("Error signing OIDC token for container ", container.ID, ": ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte(token))
+}
+
+// webIdentityCredentialSource assumes the container role with a token from
+// the OIDC issuer that identifies the container.
+type webIdentityCredentialSource struct {
+	awsSts   *lazySTSClient
+	issuer   *oidcIssuer
+	failures *failureTracker
+}
+
+func newWebIdentityCredentialSource(awsSts *lazySTSClient, issuer *oidcIssuer, failures *failureTracker) *webIdentityCredentialSource {
+	return &webIdentityCredentialSource{awsSts, issuer, failures}
+}
+
+// SharesCredentials returns false, the role trusts the token of a single
+// container and its credentials must not be given to other containers.
+func (s *webIdentityCredentialSource) SharesCredentials() bool {
+	return false
+}
+
+func (s *webIdentityCredentialSource) Credentials(req credentialsRequest) (credentials, error) {
+	if len(req.RoleChain) > 0 || len(req.Role.ExternalID) > 0 {
+		return credentials{}, errors.New("Role chains and external ids are not supported by the webidentity credential source")
+	}
+
+	awsSts, err := s.awsSts.Client()
+
+	if err != nil {
+		return credentials{}, err
+	}
+
+	subject, err := s.issuer.Subject(req.Platform, req.Container)
+
+	if err != nil {
+		return credentials{}, err
+	}
+
+	token, err := s.issuer.Token(req.Platform, req.Container)
+
+	if err != nil {
+		return credentials{}, err
+	}
+
+	var policy *string
+
+	if len(req.IamPolicy) > 0 {
+		policy = aws.String(req.IamPolicy)
+	}
+
+	var resp *sts.AssumeRoleWithWebIdentityOutput
+	roleArn := req.Role.RoleArn
+
+	// The role may trust the subjects of some containers only, so a permanent
+	// failure only applies to containers with the same subject. Permanent
+	// failures do not count toward the circuit breaker of the role.
+	cacheKey := roleArn.String() + "\x00" + req.IamPolicy + "\x00web-identity\x00" + subject
+
+	err = s.failures.Do(roleArn.String(), cacheKey, func() (err error) {
+		resp, err = awsSts.AssumeRoleWithWebIdentity(&sts.AssumeRoleWithWebIdentityInput{
+			DurationSeconds:  aws.Int64(int64(req.Duration / time.Second)),
+			Policy:           policy,
+			RoleArn:          aws.String(roleArn.String()),
+			RoleSessionName:  aws.String(req.SessionName),
+			WebIdentityToken: aws.String(token),
+		})
+		return
+	})
+
+	if err != nil {
+		return credentials{}, err
+	}
+
+	return credentials{
+		AccessKey:   *resp.Credentials.AccessKeyId,
+		SecretKey:   *resp.Credentials.SecretAccessKey,
+		Token:       *resp.Credentials.SessionToken,
+		Expiration:  *resp.Credentials.Expiration,
+		GeneratedAt: time.Now(),
+		RoleArn:     roleArn,
+	}, nil
+}
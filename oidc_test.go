@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOIDCIssuerToken(t *testing.T) {
+	assert := assert.New(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(err)
+
+	keyFile, err := ioutil.TempFile("", "ec2metaproxy-oidc")
+	assert.Nil(err)
+	defer os.Remove(keyFile.Name())
+
+	assert.Nil(pem.Encode(keyFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	keyFile.Close()
+
+	issuer, err := newOIDCIssuer("https://oidc.example.com/", "sts.amazonaws.com", `{{.Platform}}:{{.Image}}:{{.Name}}:{{index .Labels "team"}}`, keyFile.Name(), time.Hour)
+	assert.Nil(err)
+
+	token, err := issuer.Token("docker", containerInfo{
+		ID:     "abc123",
+		Name:   "/my-app",
+		Image:  "registry/my-app:1.0",
+		Labels: map[string]string{"team": "platform"},
+	})
+	assert.Nil(err)
+
+	parts := strings.Split(token, ".")
+	assert.Equal(3, len(parts))
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	assert.Nil(err)
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	assert.Nil(rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature))
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	assert.Nil(err)
+
+	var claims oidcClaims
+	assert.Nil(json.Unmarshal(claimsJSON, &claims))
+	assert.Equal("https://oidc.example.com", claims.Issuer)
+	assert.Equal("docker:registry/my-app:1.0:my-app:platform", claims.Subject)
+	assert.Equal("sts.amazonaws.com", claims.Audience)
+	assert.Equal("abc123", claims.ContainerID)
+	assert.Equal(int64(3600), claims.Expiration-claims.IssuedAt)
+}
+
+func TestOIDCIssuerRequiresHTTPS(t *testing.T) {
+	_, err := newOIDCIssuer("http://oidc.example.com", "sts.amazonaws.com", "{{.Name}}", "", time.Hour)
+	assert.NotNil(t, err)
+}
+
+// newTestOIDCIssuer returns an issuer with a new signing key.
+func newTestOIDCIssuer(t *testing.T, subject string) *oidcIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile, err := ioutil.TempFile("", "ec2metaproxy-oidc")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(keyFile.Name())
+
+	pem.Encode(keyFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	keyFile.Close()
+
+	issuer, err := newOIDCIssuer("https://oidc.example.com/", "sts.amazonaws.com", subject, keyFile.Name(), time.Hour)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return issuer
+}
+
+// tokenSubject returns the subject of a token without verifying it.
+func tokenSubject(token string) string {
+	claimsJSON, _ := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[1])
+
+	var claims oidcClaims
+	json.Unmarshal(claimsJSON, &claims)
+	return claims.Subject
+}
+
+func TestWebIdentityCredentialsAreNotShared(t *testing.T) {
+	assert := assert.New(t)
+
+	var subjects []string
+	awsSts := newFakeSTS(t, func(form map[string]string, accessKey string) error {
+		subjects = append(subjects, tokenSubject(form["WebIdentityToken"]))
+		return nil
+	})
+
+	role, _ := newRoleArn("arn:aws:iam::123456789012:role/app")
+	platform := testContainerService{
+		"172.17.0.2": {ID: "a", Name: "/a", IamRole: role},
+		"172.17.0.3": {ID: "b", Name: "/b", IamRole: role},
+	}
+	config := newTestConfig()
+	testConfigure(config, func(cfg *reloadableConfig) { cfg.ShareCredentials = true })
+
+	source := newWebIdentityCredentialSource(newLazySTSClient(func() (*sts.STS, error) { return awsSts, nil }), newTestOIDCIssuer(t, "{{.Name}}"), newFailureTracker())
+	provider := newCredentialsProvider(platform, map[string]credentialSource{"webidentity": source}, "webidentity", config, nil)
+
+	// Each container gets credentials for its own token
+	_, err := provider.CredentialsForIP("172.17.0.2")
+	assert.Nil(err)
+	_, err = provider.CredentialsForIP("172.17.0.3")
+	assert.Nil(err)
+	assert.Equal([]string{"a", "b"}, subjects)
+	assert.Len(provider.sharedCredentials, 0)
+}
+
+func TestWebIdentityFailuresArePerSubject(t *testing.T) {
+	assert := assert.New(t)
+
+	calls := make(map[string]int)
+	awsSts := newFakeSTS(t, func(form map[string]string, accessKey string) error {
+		subject := tokenSubject(form["WebIdentityToken"])
+		calls[subject]++
+
+		// The role only trusts the subject "trusted"
+		if subject != "trusted" {
+			return errors.New("Not authorized")
+		}
+
+		return nil
+	})
+
+	role, _ := newRoleArn("arn:aws:iam::123456789012:role/app")
+	failures := newFailureTracker()
+	source := newWebIdentityCredentialSource(newLazySTSClient(func() (*sts.STS, error) { return awsSts, nil }), newTestOIDCIssuer(t, "{{.Name}}"), failures)
+
+	request := func(name string) error {
+		_, err := source.Credentials(credentialsRequest{
+			Container:   containerInfo{ID: name, Name: "/" + name},
+			Platform:    "test",
+			Role:        roleChainLink{RoleArn: role},
+			SessionName: "test-" + name,
+			Duration:    time.Hour,
+		})
+		return err
+	}
+
+	// Denied containers do not open the circuit breaker of the role
+	for i := 0; i < failures.breakerThreshold+1; i++ {
+		assert.NotNil(request("rogue"))
+	}
+
+	assert.Equal(1, calls["rogue"])
+	assert.Nil(request("trusted"))
+	assert.Equal(1, calls["trusted"])
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Container labels (docker) or job metadata (flynn) with this prefix
+	// override a metadata path, e.g. ec2metaproxy.metadata.placement/availability-zone
+	metadataOverrideLabelPrefix = "ec2metaproxy.metadata."
+)
+
+// metadataOverrideRule sets metadata values and access rules for the
+// containers that match the rule. Image and Name are glob patterns and all
+// Labels must be equal.
+type metadataOverrideRule struct {
+	Image    string            `json:"image"`
+	Name     string            `json:"name"`
+	Labels   map[string]string `json:"labels"`
+	Values   map[string]string `json:"values"`
+	Allow    []string          `json:"allow"`
+	Deny     []string          `json:"deny"`
+	Disabled bool              `json:"disabled"`
+	// Behavior for matching containers without a role: none or instance-profile
+	NoRoleBehavior string `json:"no_role_behavior"`
+}
+
+type metadataOverrides struct {
+	rules []metadataOverrideRule
+}
+
+func newMetadataOverrides(file string) (*metadataOverrides, error) {
+	overrides := &metadataOverrides{}
+
+	if len(file) == 0 {
+		return overrides, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &overrides.rules); err != nil {
+		return nil, fmt.Errorf("Error parsing metadata overrides %s: %s", file, err)
+	}
+
+	for _, rule := range overrides.rules {
+		switch rule.NoRoleBehavior {
+		case "", noRoleNone, noRoleInstanceProfile:
+		default:
+			return nil, fmt.Errorf("Invalid no_role_behavior in metadata overrides %s: %s", file, rule.NoRoleBehavior)
+		}
+
+		for _, pattern := range []string{rule.Image, rule.Name} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Invalid pattern in metadata overrides %s: %s", file, pattern)
+			}
+		}
+	}
+
+	return overrides, nil
+}
+
+func (r metadataOverrideRule) Matches(container containerInfo) bool {
+	if len(r.Image) > 0 {
+		if matched, _ := path.Match(r.Image, container.Image); !matched {
+			return false
+		}
+	}
+
+	if len(r.Name) > 0 {
+		if matched, _ := path.Match(r.Name, strings.TrimPrefix(container.Name, "/")); !matched {
+			return false
+		}
+	}
+
+	for key, value := range r.Labels {
+		if container.Labels[key] != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Values returns the overridden metadata values for the container, keyed by
+// path relative to the API version (e.g. meta-data/hostname). Container labels
+// take precedence over the rules and later rules over earlier rules.
+func (o *metadataOverrides) Values(container containerInfo) map[string]string {
+	values := make(map[string]string)
+
+	for _, rule := range o.rules {
+		if rule.Matches(container) {
+			for key, value := range rule.Values {
+				values[overridePath(key)] = value
+			}
+		}
+	}
+
+	for key, value := range container.Labels {
+		if strings.HasPrefix(key, metadataOverrideLabelPrefix) {
+			values[overridePath(strings.TrimPrefix(key, metadataOverrideLabelPrefix))] = value
+		}
+	}
+
+	return values
+}
+
+// ACL returns the metadata access rules for the container: the global rules,
+// the rules of the matching override rules and the rules from the container
+// labels, which can only deny paths the other rules allow.
+func (o *metadataOverrides) ACL(container containerInfo, global metadataACL) metadataACL {
+	acl := metadataACL{
+		rules:    append([]metadataACLRule(nil), global.rules...),
+		disabled: global.disabled,
+	}
+
+	for _, rule := range o.rules {
+		if rule.Matches(container) {
+			acl.Add(rule.Allow, rule.Deny)
+			acl.disabled = acl.disabled || rule.Disabled
+		}
+	}
+
+	acl.AddContainer(splitACLPatterns(container.Labels[metadataAllowLabel]), splitACLPatterns(container.Labels[metadataDenyLabel]))
+
+	if disabled, err := strconv.ParseBool(container.Labels[metadataDisabledLabel]); err == nil && disabled {
+		acl.disabled = true
+	}
+
+	return acl
+}
+
+// NoRoleBehavior returns the behavior for the container if it does not have a
+// role, from the last matching rule that sets it.
+func (o *metadataOverrides) NoRoleBehavior(container containerInfo) string {
+	behavior := ""
+
+	for _, rule := range o.rules {
+		if len(rule.NoRoleBehavior) > 0 && rule.Matches(container) {
+			behavior = rule.NoRoleBehavior
+		}
+	}
+
+	return behavior
+}
+
+// overridePath converts an override key to a path relative to the API
+// version. Keys are relative to meta-data, except for user-data and dynamic.
+func overridePath(key string) string {
+	key = strings.Trim(key, "/")
+
+	if key == "user-data" || key == "dynamic" || strings.HasPrefix(key, "dynamic/") || strings.HasPrefix(key, "meta-data/") {
+		return key
+	}
+
+	return "meta-data/" + key
+}
+
+// metadataListing returns the directory entries the overridden values add to
+// the directory at subpath. Subdirectories have a trailing slash, like in the
+// listings of the EC2 metadata service.
+func metadataListing(values map[string]string, subpath string) []string {
+	prefix := strings.Trim(subpath, "/") + "/"
+
+	if prefix == "/" {
+		prefix = ""
+	}
+
+	entries := make(map[string]bool)
+
+	for key := range values {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		entry := strings.TrimPrefix(key, prefix)
+
+		if index := strings.Index(entry, "/"); index >= 0 {
+			entry = entry[:index+1]
+		}
+
+		entries[entry] = true
+	}
+
+	result := make([]string, 0, len(entries))
+
+	for entry := range entries {
+		result = append(result, entry)
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+// mergeListing adds the entries to a directory listing of the EC2 metadata
+// service, skipping entries that are already listed.
+func mergeListing(listing string, entries []string) string {
+	var lines []string
+	existing := make(map[string]bool)
+
+	for _, line := range strings.Split(listing, "\n") {
+		if len(line) > 0 {
+			lines = append(lines, line)
+			existing[strings.TrimSuffix(line, "/")] = true
+		}
+	}
+
+	for _, entry := range entries {
+		if !existing[strings.TrimSuffix(entry, "/")] {
+			lines = append(lines, entry)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
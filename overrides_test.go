@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadataOverridesValues(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "overrides")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "overrides.json")
+	assert.Nil(ioutil.WriteFile(file, []byte(`[
+		{"values": {"placement/availability-zone": "us-east-1z"}},
+		{"image": "nginx:*", "values": {"hostname": "web", "tags/instance/Team": "web"}},
+		{"labels": {"tier": "db"}, "values": {"hostname": "db"}}
+	]`), 0644))
+
+	overrides, err := newMetadataOverrides(file)
+	assert.Nil(err)
+
+	assert.Equal(map[string]string{
+		"meta-data/placement/availability-zone": "us-east-1z",
+		"meta-data/hostname":                    "web",
+		"meta-data/tags/instance/Team":          "web",
+		"user-data":                             "#!/bin/sh",
+	}, overrides.Values(containerInfo{
+		Image:  "nginx:latest",
+		Labels: map[string]string{"ec2metaproxy.metadata.user-data": "#!/bin/sh"},
+	}))
+
+	assert.Equal(map[string]string{
+		"meta-data/placement/availability-zone": "us-east-1z",
+		"meta-data/hostname":                    "db-1",
+	}, overrides.Values(containerInfo{
+		Image:  "postgres:latest",
+		Labels: map[string]string{"tier": "db", "ec2metaproxy.metadata.hostname": "db-1"},
+	}))
+}
+
+func TestMetadataListing(t *testing.T) {
+	assert := assert.New(t)
+
+	values := map[string]string{
+		"meta-data/hostname":           "web",
+		"meta-data/tags/instance/Team": "web",
+		"meta-data/tags/instance/Name": "web-1",
+		"user-data":                    "",
+	}
+
+	assert.Equal([]string{"meta-data/", "user-data"}, metadataListing(values, ""))
+	assert.Equal([]string{"hostname", "tags/"}, metadataListing(values, "meta-data/"))
+	assert.Equal([]string{"Name", "Team"}, metadataListing(values, "meta-data/tags/instance"))
+	assert.Equal([]string{}, metadataListing(values, "meta-data/placement"))
+
+	assert.Equal("ami-id\nhostname\ntags/", mergeListing("ami-id\nhostname", []string{"hostname", "tags/"}))
+	assert.Equal("Name\nTeam", mergeListing("", []string{"Name", "Team"}))
+}
+
+func TestMetadataProxyOverrides(t *testing.T) {
+	assert := assert.New(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/meta-data/":
+			w.Write([]byte("ami-id\nhostname\nplacement/"))
+		case "/latest/meta-data/hostname":
+			w.Write([]byte("ip-10-0-0-1.ec2.internal"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	platform := testContainerService{"172.17.0.2": {
+		ID:     "container-a",
+		Labels: map[string]string{"ec2metaproxy.metadata.hostname": "web", "ec2metaproxy.metadata.tags/instance/Name": "web-1"},
+	}}
+	proxy := newMetadataProxy(upstream.URL, &http.Transport{}, platform, newTestConfig())
+
+	w := testRequest(proxy.Handle, "GET", "/latest/meta-data/hostname", "172.17.0.2")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("web", w.Body.String())
+
+	w = testRequest(proxy.Handle, "GET", "/latest/meta-data/", "172.17.0.2")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("ami-id\nhostname\nplacement/\ntags/", w.Body.String())
+
+	w = testRequest(proxy.Handle, "GET", "/latest/meta-data/tags/instance", "172.17.0.2")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("Name", w.Body.String())
+
+	w = testRequest(proxy.Handle, "GET", "/latest/meta-data/ami-id", "172.17.0.2")
+	assert.Equal(http.StatusNotFound, w.Code)
+
+	// Other containers get the values of the metadata service
+	w = testRequest(proxy.Handle, "GET", "/latest/meta-data/hostname", "172.17.0.3")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("ip-10-0-0-1.ec2.internal", w.Body.String())
+}
+
+func TestMetadataProxyNetworkIdentity(t *testing.T) {
+	assert := assert.New(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/meta-data/local-ipv4":
+			w.Write([]byte("10.0.0.1"))
+		case "/latest/meta-data/mac":
+			w.Write([]byte("0a:00:00:00:00:01"))
+		case "/latest/meta-data/network/interfaces/macs/0a:00:00:00:00:01/":
+			w.Write([]byte("device-number\nlocal-ipv4s\nmac\nsubnet-id\nvpc-id"))
+		case "/latest/meta-data/network/interfaces/macs/0a:00:00:00:00:01/vpc-id":
+			w.Write([]byte("vpc-1234"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	platform := testContainerService{"172.17.0.2": {
+		ID:         "container-a",
+		IPAddress:  "172.17.0.2",
+		Hostname:   "web-1",
+		MacAddress: "02:42:ac:11:00:02",
+	}}
+	config := newTestConfig()
+	testConfigure(config, func(cfg *reloadableConfig) { cfg.NetworkIdentity = true })
+	proxy := newMetadataProxy(upstream.URL, &http.Transport{}, platform, config)
+
+	assert.Equal("172.17.0.2", testRequest(proxy.Handle, "GET", "/latest/meta-data/local-ipv4", "172.17.0.2").Body.String())
+	assert.Equal("web-1", testRequest(proxy.Handle, "GET", "/latest/meta-data/local-hostname", "172.17.0.2").Body.String())
+	assert.Equal("web-1", testRequest(proxy.Handle, "GET", "/latest/meta-data/hostname", "172.17.0.2").Body.String())
+	assert.Equal("02:42:ac:11:00:02", testRequest(proxy.Handle, "GET", "/latest/meta-data/mac", "172.17.0.2").Body.String())
+	assert.Equal("02:42:ac:11:00:02/", testRequest(proxy.Handle, "GET", "/latest/meta-data/network/interfaces/macs/", "172.17.0.2").Body.String())
+	assert.Equal("device-number\nlocal-ipv4s\nmac\nsubnet-id\nvpc-id\nlocal-hostname", testRequest(proxy.Handle, "GET", "/latest/meta-data/network/interfaces/macs/02:42:ac:11:00:02/", "172.17.0.2").Body.String())
+	assert.Equal("172.17.0.2", testRequest(proxy.Handle, "GET", "/latest/meta-data/network/interfaces/macs/02:42:ac:11:00:02/local-ipv4s", "172.17.0.2").Body.String())
+	assert.Equal("vpc-1234", testRequest(proxy.Handle, "GET", "/latest/meta-data/network/interfaces/macs/02:42:ac:11:00:02/vpc-id", "172.17.0.2").Body.String())
+	assert.Equal(http.StatusNotFound, testRequest(proxy.Handle, "GET", "/latest/meta-data/network/interfaces/macs/0a:00:00:00:00:01/vpc-id", "172.17.0.2").Code)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	podIdentityEndpointIP      = "169.254.170.23"
+	podIdentityCredentialsPath = "/v1/credentials"
+)
+
+type podIdentityCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	AccountID       string `json:"AccountId"`
+	Expiration      string
+}
+
+// podIdentityHandler emulates the credentials endpoint of the EKS Pod Identity
+// agent. SDKs call it with the token from AWS_CONTAINER_AUTHORIZATION_TOKEN or
+// AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE in the Authorization header.
+type podIdentityHandler struct {
+	platform    containerService
+	tokens      *containerTokens
+	credentials *credentialsProvider
+	// Metadata access rules of the containers
+	config *liveConfig
+	// If false, the caller is authenticated by source IP only
+	requireToken bool
+}
+
+func newPodIdentityHandler(platform containerService, tokens *containerTokens, credentials *credentialsProvider, config *liveConfig, requireToken bool) *podIdentityHandler {
+	return &podIdentityHandler{platform, tokens, credentials, config, requireToken}
+}
+
+func (p *podIdentityHandler) HandleCredentials(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientIP := remoteIP(r.RemoteAddr)
+	container, err := p.platform.ContainerForIP(clientIP)
+
+	if err != nil {
+		log.Error(clientIP, " ", err)
+		http.Error(w, "No container found for request", http.StatusBadRequest)
+		return
+	}
+
+	if p.requireToken {
+		token := r.Header.Get("Authorization")
+
+		if len(token) == 0 {
+			http.Error(w, "Authorization token is required", http.StatusBadRequest)
+			return
+		}
+
+		if !p.tokens.ValidToken(container.ID, token) {
+			http.Error(w, "Invalid authorization token", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if !p.config.Load().ContainerACL(container).Allowed(securityCredentialsPath) {
+		log.Debug("Credentials are denied for ", clientIP)
+		http.Error(w, "Credentials are denied for container", http.StatusForbidden)
+		return
+	}
+
+	credentials, err := p.credentials.CredentialsForIP(clientIP)
+
+	if err == errNoCredentials || err == errInstanceProfile {
+		http.Error(w, "No credentials for container", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Error(clientIP, " ", err)
+		http.Error(w, "An unexpected error getting container role", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, &podIdentityCredentials{
+		AccessKeyID:     credentials.AccessKey,
+		SecretAccessKey: credentials.SecretKey,
+		Token:           credentials.Token,
+		AccountID:       credentials.RoleArn.AccountID(),
+		Expiration:      credentials.Expiration.UTC().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPodIdentityCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	platform := testContainerService{
+		"172.17.0.2": {ID: "container-a"},
+		"172.17.0.4": {ID: "container-c", Labels: map[string]string{"ec2metaproxy.disabled": "true"}},
+	}
+	tokens, err := newContainerTokens("")
+	assert.Nil(err)
+
+	credentials := newTestCredentialsProvider(platform)
+	handler := newPodIdentityHandler(platform, tokens, credentials, credentials.config, true)
+	w := testRequest(handler.HandleCredentials, "GET", podIdentityCredentialsPath, "172.17.0.2", "Authorization: "+tokens.Token("container-a"))
+	assert.Equal(http.StatusOK, w.Code)
+
+	var creds podIdentityCredentials
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &creds))
+	assert.Equal("AKID", creds.AccessKeyID)
+	assert.Equal("SECRET", creds.SecretAccessKey)
+	assert.Equal("TOKEN", creds.Token)
+	assert.Equal("123456789012", creds.AccountID)
+
+	assert.Equal(http.StatusBadRequest, testRequest(handler.HandleCredentials, "GET", podIdentityCredentialsPath, "172.17.0.2").Code)
+	assert.Equal(http.StatusUnauthorized, testRequest(handler.HandleCredentials, "GET", podIdentityCredentialsPath, "172.17.0.2", "Authorization: "+tokens.Token("container-b")).Code)
+	assert.Equal(http.StatusBadRequest, testRequest(handler.HandleCredentials, "GET", podIdentityCredentialsPath, "172.17.0.3", "Authorization: "+tokens.Token("container-a")).Code)
+
+	// Metadata access rules apply
+	assert.Equal(http.StatusForbidden, testRequest(handler.HandleCredentials, "GET", podIdentityCredentialsPath, "172.17.0.4", "Authorization: "+tokens.Token("container-c")).Code)
+
+	// Source IP only
+	handler = newPodIdentityHandler(platform, tokens, credentials, credentials.config, false)
+	assert.Equal(http.StatusOK, testRequest(handler.HandleCredentials, "GET", podIdentityCredentialsPath, "172.17.0.2").Code)
+	assert.Equal(http.StatusBadRequest, testRequest(handler.HandleCredentials, "GET", podIdentityCredentialsPath, "172.17.0.3").Code)
+
+	testConfigure(credentials.config, func(cfg *reloadableConfig) { cfg.MetadataACL = newMetadataACL(nil, []string{"iam"}) })
+	assert.Equal(http.StatusForbidden, testRequest(handler.HandleCredentials, "GET", podIdentityCredentialsPath, "172.17.0.2").Code)
+}
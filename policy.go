@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	policyFileExt = ".json"
+)
+
+var (
+	policyNameRegex = regexp.MustCompile(`^[\w+=,.@-]+$`)
+)
+
+type policyStore struct {
+	dir      string
+	policies map[string]string
+	modTimes map[string]time.Time
+	lock     sync.RWMutex
+}
+
+func newPolicyStore(dir string) (*policyStore, error) {
+	store := &policyStore{
+		dir:      dir,
+		policies: make(map[string]string),
+		modTimes: make(map[string]time.Time),
+	}
+
+	if len(dir) > 0 {
+		if err := store.Reload(); err != nil {
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+// Policy returns the contents of the named policy. The name is the policy
+// file name without the extension.
+func (p *policyStore) Policy(name string) (string, error) {
+	if len(p.dir) == 0 {
+		return "", fmt.Errorf("IAM policy %s requested but no policy directory is configured", name)
+	}
+
+	if !policyNameRegex.MatchString(name) {
+		return "", fmt.Errorf("Invalid IAM policy name: %s", name)
+	}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	policy, found := p.policies[name]
+
+	if !found {
+		return "", fmt.Errorf("Unknown IAM policy: %s", name)
+	}
+
+	return policy, nil
+}
+
+// Reload reads all policy files in the policy directory. Files that can not be
+// read or that are not valid JSON are skipped. The previous set of policies is
+// kept if the directory can not be listed.
+func (p *policyStore) Reload() error {
+	files, err := ioutil.ReadDir(p.dir)
+
+	if err != nil {
+		return err
+	}
+
+	policies := make(map[string]string)
+	modTimes := make(map[string]time.Time)
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != policyFileExt {
+			continue
+		}
+
+		name := strings.TrimSuffix(file.Name(), policyFileExt)
+
+		if !policyNameRegex.MatchString(name) {
+			log.Warn("Ignoring IAM policy file with invalid name: ", file.Name())
+			continue
+		}
+
+		modTimes[name] = file.ModTime()
+		policy, err := readPolicyFile(filepath.Join(p.dir, file.Name()))
+
+		if err != nil {
+			log.Error("Error reading IAM policy file ", file.Name(), ": ", err)
+			continue
+		}
+
+		policies[name] = policy
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.policies = policies
+	p.modTimes = modTimes
+	return nil
+}
+
+// Changed returns true if any policy file was added, removed or modified since
+// the last reload.
+func (p *policyStore) Changed() bool {
+	files, err := ioutil.ReadDir(p.dir)
+
+	if err != nil {
+		log.Warn("Error listing IAM policy directory ", p.dir, ": ", err)
+		return false
+	}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	count := 0
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != policyFileExt {
+			continue
+		}
+
+		name := strings.TrimSuffix(file.Name(), policyFileExt)
+
+		if !policyNameRegex.MatchString(name) {
+			continue
+		}
+
+		count++
+
+		if modTime, found := p.modTimes[name]; !found || !modTime.Equal(file.ModTime()) {
+			return true
+		}
+	}
+
+	return count != len(p.modTimes)
+}
+
+// Watch polls the policy directory and reloads the policies when it changes.
+func (p *policyStore) Watch(interval time.Duration) {
+	if len(p.dir) == 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			if !p.Changed() {
+				continue
+			}
+
+			log.Info("Reloading IAM policies from ", p.dir)
+
+			if err := p.Reload(); err != nil {
+				log.Error("Error reloading IAM policies from ", p.dir, ": ", err)
+			}
+		}
+	}()
+}
+
+func readPolicyFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return "", err
+	}
+
+	var policy bytes.Buffer
+
+	if err := json.Compact(&policy, data); err != nil {
+		return "", err
+	}
+
+	return policy.String(), nil
+}
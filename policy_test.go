@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyStore(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ec2metaproxy-policies")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "readonly-s3.json"), []byte(`{
+  "Version": "2012-10-17",
+  "Statement": {"Effect": "Allow", "Resource": "*", "Action": "s3:Get*"}
+}`), 0644))
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "invalid.json"), []byte(`{`), 0644))
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte(`ignored`), 0644))
+
+	store, err := newPolicyStore(dir)
+	assert.Nil(err)
+
+	policy, err := store.Policy("readonly-s3")
+	assert.Nil(err)
+	assert.Equal(`{"Version":"2012-10-17","Statement":{"Effect":"Allow","Resource":"*","Action":"s3:Get*"}}`, policy)
+
+	_, err = store.Policy("invalid")
+	assert.NotNil(err)
+
+	_, err = store.Policy("README")
+	assert.NotNil(err)
+
+	_, err = store.Policy("../readonly-s3")
+	assert.NotNil(err)
+
+	assert.False(store.Changed())
+
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "admin.json"), []byte(`{}`), 0644))
+	assert.True(store.Changed())
+
+	assert.Nil(store.Reload())
+	assert.False(store.Changed())
+
+	policy, err = store.Policy("admin")
+	assert.Nil(err)
+	assert.Equal(`{}`, policy)
+
+	future := time.Now().Add(time.Hour)
+	assert.Nil(os.Chtimes(filepath.Join(dir, "admin.json"), future, future))
+	assert.True(store.Changed())
+
+	assert.Nil(os.Remove(filepath.Join(dir, "readonly-s3.json")))
+	assert.Nil(store.Reload())
+
+	_, err = store.Policy("readonly-s3")
+	assert.NotNil(err)
+}
+
+func TestPolicyStoreWithoutDirectory(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := newPolicyStore("")
+	assert.Nil(err)
+
+	_, err = store.Policy("readonly-s3")
+	assert.NotNil(err)
+}
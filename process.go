@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// processCredentialSource runs an external command that prints credentials in
+// the format used by the credential_process setting of the AWS CLI and SDKs.
+type processCredentialSource struct {
+	command string
+	timeout time.Duration
+}
+
+type processCredentials struct {
+	Version         int
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      *time.Time
+}
+
+func newProcessCredentialSource(command string, timeout time.Duration) *processCredentialSource {
+	return &processCredentialSource{command, timeout}
+}
+
+// Credentials runs the command with the shell. The request is passed to the
+// command in environment variables.
+func (p *processCredentialSource) Credentials(req credentialsRequest) (credentials, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", p.command)
+	cmd.Env = append(os.Environ(),
+		"CONTAINER_ID="+req.Container.ID,
+		"CONTAINER_NAME="+req.Container.Name,
+		"CONTAINER_PLATFORM="+req.Platform,
+		"IAM_ROLE="+req.Role.RoleArn.String(),
+		"IAM_EXTERNAL_ID="+req.Role.ExternalID,
+		"IAM_ROLE_CHAIN="+req.RoleChain.String(),
+		"IAM_POLICY="+req.IamPolicy,
+		"ROLE_SESSION_NAME="+req.SessionName,
+		fmt.Sprintf("DURATION_SECONDS=%d", int64(req.Duration/time.Second)),
+	)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	generatedAt := time.Now()
+
+	if err := cmd.Run(); err != nil {
+		return credentials{}, fmt.Errorf("Error running credential process: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var output processCredentials
+
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+		return credentials{}, fmt.Errorf("Error decoding credential process output: %s", err)
+	}
+
+	if output.Version != 1 {
+		return credentials{}, fmt.Errorf("Unsupported credential process output version: %d", output.Version)
+	}
+
+	if len(output.AccessKeyID) == 0 || len(output.SecretAccessKey) == 0 {
+		return credentials{}, fmt.Errorf("Credential process output is missing the access key")
+	}
+
+	// Credentials without an expiration are refreshed like assumed role
+	// credentials
+	expiration := generatedAt.Add(req.Duration)
+
+	if output.Expiration != nil {
+		expiration = *output.Expiration
+	}
+
+	return credentials{
+		AccessKey:   output.AccessKeyID,
+		SecretKey:   output.SecretAccessKey,
+		Token:       output.SessionToken,
+		Expiration:  expiration,
+		GeneratedAt: generatedAt,
+		RoleArn:     req.Role.RoleArn,
+	}, nil
+}
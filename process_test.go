@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessCredentialSource(t *testing.T) {
+	assert := assert.New(t)
+
+	source := newProcessCredentialSource(`echo "{\"Version\": 1, \"AccessKeyId\": \"AKID-$CONTAINER_ID\", \"SecretAccessKey\": \"secret\", \"SessionToken\": \"token\", \"Expiration\": \"2030-01-02T03:04:05Z\"}"`, 10*time.Second)
+	arn, _ := newRoleArn("arn:aws:iam::123456789012:role/test-role-name")
+
+	creds, err := source.Credentials(credentialsRequest{
+		Container: containerInfo{ID: "abc123"},
+		Role:      roleChainLink{RoleArn: arn},
+		Duration:  time.Hour,
+	})
+
+	assert.Nil(err)
+	assert.Equal("AKID-abc123", creds.AccessKey)
+	assert.Equal("secret", creds.SecretKey)
+	assert.Equal("token", creds.Token)
+	assert.Equal(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC), creds.Expiration.UTC())
+	assert.Equal("test-role-name", creds.RoleArn.RoleName())
+}
+
+func TestProcessCredentialSourceErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, command := range []string{
+		`exit 1`,
+		`echo not-json`,
+		`echo '{"Version": 2, "AccessKeyId": "a", "SecretAccessKey": "b"}'`,
+		`echo '{"Version": 1, "SecretAccessKey": "b"}'`,
+	} {
+		_, err := newProcessCredentialSource(command, 10*time.Second).Credentials(credentialsRequest{Duration: time.Hour})
+		assert.NotNil(err, command)
+	}
+}
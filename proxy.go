@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+var (
+	metadataPathRegex = regexp.MustCompile("^/([^/]+)/(.*)$")
+)
+
+// metadataProxy forwards requests to the EC2 metadata service and serves the
+// metadata values that are overridden for the container that made the request.
+type metadataProxy struct {
+	baseURL   string
+	transport http.RoundTripper
+	platform  containerService
+	// Overrides, access rules and whether the container network identity is
+	// served
+	config *liveConfig
+	// IP TTL of token responses, 0 to use the system default
+	tokenHopLimit int
+	// nil if responses are not cached
+	cache *metadataCache
+	// nil if responses are not served from a snapshot when the metadata
+	// service is unavailable
+	snapshot *metadataSnapshot
+}
+
+func newMetadataProxy(baseURL string, transport http.RoundTripper, platform containerService, config *liveConfig) *metadataProxy {
+	return &metadataProxy{
+		baseURL:   baseURL,
+		transport: transport,
+		platform:  platform,
+		config:    config,
+	}
+}
+
+// Authorize applies the access rules of the container that made the request.
+// It writes an error response and returns false if the path is denied.
+func (p *metadataProxy) Authorize(w http.ResponseWriter, r *http.Request) bool {
+	match := metadataPathRegex.FindStringSubmatch(r.URL.Path)
+
+	if match == nil {
+		return true
+	}
+
+	cfg := p.config.Load()
+	acl := cfg.MetadataACL
+	clientIP := remoteIP(r.RemoteAddr)
+
+	if container, err := p.platform.ContainerForIP(clientIP); err == nil {
+		acl = cfg.ContainerACL(container)
+	}
+
+	subpath := strings.Trim(match[2], "/")
+
+	if acl.disabled {
+		log.Debug("Metadata is disabled for ", clientIP)
+		writeIMDSError(w, http.StatusForbidden)
+		return false
+	}
+
+	// Without a token, the container can not read the allowed paths with IMDSv2
+	if subpath == "api/token" {
+		return true
+	}
+
+	if !acl.Allowed(subpath) {
+		log.Debug("Metadata path ", subpath, " is denied for ", clientIP)
+		writeIMDSError(w, cfg.MetadataDeniedStatus)
+		return false
+	}
+
+	return true
+}
+
+func (p *metadataProxy) Handle(w http.ResponseWriter, r *http.Request) {
+	match := metadataPathRegex.FindStringSubmatch(r.URL.Path)
+
+	if match != nil && r.Method == "PUT" && strings.Trim(match[2], "/") == "api/token" {
+		p.handleToken(w, r)
+		return
+	}
+
+	if match == nil || r.Method != "GET" {
+		p.proxy(w, r)
+		return
+	}
+
+	container, err := p.platform.ContainerForIP(remoteIP(r.RemoteAddr))
+
+	if err != nil {
+		log.Debug("No metadata overrides for ", remoteIP(r.RemoteAddr), ": ", err)
+		p.proxy(w, r)
+		return
+	}
+
+	cfg := p.config.Load()
+	apiVersion, subpath := match[1], match[2]
+	upstreamPath := r.URL.Path
+	values := cfg.Overrides.Values(container)
+
+	if cfg.NetworkIdentity {
+		for key, value := range networkIdentityValues(container) {
+			if _, found := values[key]; !found {
+				values[key] = value
+			}
+		}
+
+		if len(container.MacAddress) > 0 && strings.HasPrefix(subpath, macsMetadataPath) {
+			if strings.Trim(subpath, "/") == macsMetadataPath {
+				writeMetadata(w, container.MacAddress+"/")
+				return
+			}
+
+			mac, rest, ok := splitMacPath(subpath)
+
+			if !ok || mac != container.MacAddress {
+				http.NotFound(w, r)
+				return
+			}
+
+			// Other values of the container interface are the values of the
+			// primary interface of the host
+			hostMac, err := p.fetch(r, "/"+apiVersion+"/meta-data/mac")
+
+			if err != nil {
+				log.Error("Error getting host MAC address from EC2 metadata service: ", err)
+				writeUpstreamError(w, err)
+				return
+			}
+
+			upstreamPath = "/" + apiVersion + "/" + macsMetadataPath + "/" + hostMac + rest
+		}
+	}
+
+	if len(values) == 0 {
+		p.proxyPath(w, r, upstreamPath)
+		return
+	}
+
+	if value, found := values[strings.TrimSuffix(subpath, "/")]; found {
+		writeMetadata(w, value)
+		return
+	}
+
+	entries := metadataListing(values, subpath)
+
+	if len(entries) == 0 {
+		p.proxyPath(w, r, upstreamPath)
+		return
+	}
+
+	resp, err := p.roundTrip(r, upstreamPath)
+
+	if err != nil {
+		log.Error("Error forwarding request to EC2 metadata service: ", err)
+		writeUpstreamError(w, err)
+		return
+	}
+
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		listing, err := ioutil.ReadAll(resp.Body)
+
+		if err != nil {
+			log.Error("Error reading response from EC2 metadata service: ", err)
+			writeUpstreamError(w, err)
+			return
+		}
+
+		writeMetadata(w, mergeListing(string(listing), entries))
+	case http.StatusNotFound:
+		// The directory only exists in the overrides
+		writeMetadata(w, mergeListing("", entries))
+	default:
+		writeResponse(w, resp)
+	}
+}
+
+// proxy forwards the request to the EC2 metadata service unchanged.
+func (p *metadataProxy) proxy(w http.ResponseWriter, r *http.Request) {
+	p.proxyPath(w, r, r.URL.Path)
+}
+
+// proxyPath forwards the request to another path of the EC2 metadata service.
+func (p *metadataProxy) proxyPath(w http.ResponseWriter, r *http.Request, path string) {
+	resp, err := p.roundTrip(r, path)
+
+	if err != nil {
+		log.Error("Error forwarding request to EC2 metadata service: ", err)
+		writeUpstreamError(w, err)
+		return
+	}
+
+	defer resp.Body.Close()
+	writeResponse(w, resp)
+}
+
+func (p *metadataProxy) roundTrip(r *http.Request, path string) (*http.Response, error) {
+	resp, err := p.cachedRoundTrip(r, path)
+	match := metadataPathRegex.FindStringSubmatch(path)
+
+	if p.snapshot == nil || match == nil {
+		return resp, err
+	}
+
+	subpath := match[2]
+
+	if err == nil && resp.StatusCode < http.StatusInternalServerError {
+		if r.Method != "GET" || resp.StatusCode != http.StatusOK || !snapshotEligible(subpath) {
+			return resp, nil
+		}
+
+		response, err := readResponse(resp, nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		p.snapshot.Record(subpath, response.header.Get("Content-Type"), response.body)
+		return response.Response(), nil
+	}
+
+	// The metadata service is unavailable
+	reason := fmt.Sprint(err)
+
+	if err == nil {
+		reason = resp.Status
+	}
+
+	if r.Method == "PUT" && strings.Trim(subpath, "/") == "api/token" {
+		log.Warn("EC2 metadata service unavailable, issuing token from the proxy: ", reason)
+		closeResponse(resp)
+		return p.snapshot.TokenResponse(r)
+	}
+
+	if r.Method == "GET" {
+		if snapshotResp, found := p.snapshot.Response(subpath); found {
+			log.Warn("EC2 metadata service unavailable, serving ", subpath, " from snapshot: ", reason)
+			closeResponse(resp)
+			return snapshotResp, nil
+		}
+	}
+
+	return resp, err
+}
+
+func closeResponse(resp *http.Response) {
+	if resp != nil {
+		resp.Body.Close()
+	}
+}
+
+func (p *metadataProxy) cachedRoundTrip(r *http.Request, path string) (*http.Response, error) {
+	proxyReq, err := http.NewRequest(r.Method, fmt.Sprintf("%s%s", p.baseURL, path), r.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	copyHeaders(proxyReq.Header, r.Header)
+
+	if p.cache != nil && r.Method == "GET" {
+		if match := metadataPathRegex.FindStringSubmatch(path); match != nil {
+			if ttl := p.cache.TTL(match[2]); ttl > 0 {
+				// The token is part of the key, so that a request with an
+				// invalid token does not get a cached response
+				key := r.Header.Get("X-aws-ec2-metadata-token") + "\x00" + path
+
+				return p.cache.Do(key, ttl, func() (*http.Response, error) {
+					return p.transport.RoundTrip(proxyReq)
+				})
+			}
+		}
+	}
+
+	return p.transport.RoundTrip(proxyReq)
+}
+
+// fetch returns a value from the EC2 metadata service using the headers of
+// the request, such as the IMDSv2 token.
+func (p *metadataProxy) fetch(r *http.Request, path string) (string, error) {
+	resp, err := p.roundTrip(r, path)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Error fetching %s from metadata service: %s", path, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func writeResponse(w http.ResponseWriter, resp *http.Response) {
+	copyHeaders(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		log.Warn("Error copying response content from EC2 metadata service: ", err)
+	}
+}
+
+// writeUpstreamError writes an error page like the EC2 metadata service for a
+// failed request to the metadata service.
+func writeUpstreamError(w http.ResponseWriter, err error) {
+	if isTimeout(err) {
+		writeIMDSError(w, http.StatusGatewayTimeout)
+	} else {
+		writeIMDSError(w, http.StatusBadGateway)
+	}
+}
+
+func writeMetadata(w http.ResponseWriter, value string) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+	w.Write([]byte(value))
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	log "github.com/cihub/seelog"
+)
+
+var (
+	errCircuitOpen = errors.New("too many recent failures assuming role, not retrying until the circuit breaker closes")
+
+	throttleErrorCodes = map[string]struct{}{
+		"Throttling":                             {},
+		"ThrottlingException":                    {},
+		"ThrottledException":                     {},
+		"RequestThrottled":                       {},
+		"RequestLimitExceeded":                   {},
+		"TooManyRequestsException":               {},
+		"ProvisionedThroughputExceededException": {},
+		"IDPCommunicationError":                  {},
+		"RequestError":                           {}, // Network errors
+	}
+
+	// Errors that will fail the same way no matter how often the request is retried
+	permanentErrorCodes = map[string]struct{}{
+		"AccessDenied":                {},
+		"AccessDeniedException":       {},
+		"MalformedPolicyDocument":     {},
+		"PackedPolicyTooLarge":        {},
+		"RegionDisabledException":     {},
+		"ValidationError":             {},
+		"InvalidParameterValue":       {},
+		"InvalidIdentityToken":        {},
+		"InvalidClientTokenId":        {},
+		"UnrecognizedClientException": {},
+	}
+)
+
+func isRetryableError(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() >= 500 {
+		return true
+	}
+
+	if awsErr, ok := err.(awserr.Error); ok {
+		_, found := throttleErrorCodes[awsErr.Code()]
+		return found
+	}
+
+	return false
+}
+
+func isPermanentError(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		_, found := permanentErrorCodes[awsErr.Code()]
+		return found
+	}
+
+	return false
+}
+
+type circuitBreaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+type negativeCacheEntry struct {
+	err     error
+	expires time.Time
+}
+
+// failureTracker retries failed requests with jittered exponential backoff,
+// stops calling a role that keeps failing (circuit breaker) and remembers
+// errors that are certain to happen again (negative cache).
+type failureTracker struct {
+	maxAttempts      int
+	baseDelay        time.Duration
+	maxDelay         time.Duration
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	negativeCacheTTL time.Duration
+	breakers         map[string]*circuitBreaker
+	negativeCache    map[string]negativeCacheEntry
+	sleep            func(time.Duration)
+	now              func() time.Time
+	lock             sync.Mutex
+}
+
+func newFailureTracker() *failureTracker {
+	return &failureTracker{
+		maxAttempts:      3,
+		baseDelay:        200 * time.Millisecond,
+		maxDelay:         2 * time.Second,
+		breakerThreshold: 5,
+		breakerCooldown:  30 * time.Second,
+		negativeCacheTTL: 30 * time.Second,
+		breakers:         make(map[string]*circuitBreaker),
+		negativeCache:    make(map[string]negativeCacheEntry),
+		sleep:            time.Sleep,
+		now:              time.Now,
+	}
+}
+
+// Do calls fn until it succeeds, fails with an error that is not retryable, or
+// the maximum number of attempts is reached. The circuit breaker is tracked per
+// breakerKey (the role) and negative results are cached per cacheKey (the role
+// and everything else that makes up the request).
+func (f *failureTracker) Do(breakerKey, cacheKey string, fn func() error) error {
+	if err := f.check(breakerKey, cacheKey); err != nil {
+		return err
+	}
+
+	var err error
+	maxAttempts := f.maxAttempts
+
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			delay := f.backoff(attempt)
+			log.Debugf("Retrying %s in %s after error: %s", breakerKey, delay, err)
+			f.sleep(delay)
+		}
+
+		err = fn()
+
+		if err == nil {
+			f.success(breakerKey)
+			return nil
+		}
+
+		if isPermanentError(err) {
+			f.permanentFailure(cacheKey, err)
+			return err
+		}
+
+		if !isRetryableError(err) {
+			break
+		}
+	}
+
+	f.failure(breakerKey)
+	return err
+}
+
+func (f *failureTracker) backoff(attempt int) time.Duration {
+	delay := f.baseDelay << uint(attempt-1)
+
+	if delay > f.maxDelay || delay <= 0 {
+		delay = f.maxDelay
+	}
+
+	// Full jitter
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+func (f *failureTracker) check(breakerKey, cacheKey string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	now := f.now()
+
+	if entry, found := f.negativeCache[cacheKey]; found {
+		if now.Before(entry.expires) {
+			return entry.err
+		}
+
+		delete(f.negativeCache, cacheKey)
+	}
+
+	if breaker, found := f.breakers[breakerKey]; found && now.Before(breaker.openUntil) {
+		return errCircuitOpen
+	}
+
+	return nil
+}
+
+func (f *failureTracker) success(breakerKey string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.breakers, breakerKey)
+}
+
+func (f *failureTracker) failure(breakerKey string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	breaker, found := f.breakers[breakerKey]
+
+	if !found {
+		breaker = &circuitBreaker{}
+		f.breakers[breakerKey] = breaker
+	}
+
+	breaker.failures++
+
+	// Once the breaker has opened, a single failed attempt after the cooldown
+	// (half open) opens it again.
+	if f.breakerThreshold > 0 && breaker.failures >= f.breakerThreshold {
+		log.Warnf("Opening circuit breaker for %s for %s after %d failures", breakerKey, f.breakerCooldown, breaker.failures)
+		breaker.openUntil = f.now().Add(f.breakerCooldown)
+	}
+}
+
+func (f *failureTracker) permanentFailure(cacheKey string, err error) {
+	if f.negativeCacheTTL <= 0 {
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.negativeCache[cacheKey] = negativeCacheEntry{err, f.now().Add(f.negativeCacheTTL)}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestFailureTracker(now *time.Time) *failureTracker {
+	tracker := newFailureTracker()
+	tracker.sleep = func(time.Duration) {}
+	tracker.now = func() time.Time { return *now }
+	return tracker
+}
+
+func TestFailureTrackerRetriesThrottling(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	tracker := newTestFailureTracker(&now)
+
+	calls := 0
+	err := tracker.Do("role", "role+policy", func() error {
+		calls++
+
+		if calls < 3 {
+			return awserr.NewRequestFailure(awserr.New("Throttling", "Rate exceeded", nil), 400, "")
+		}
+
+		return nil
+	})
+
+	assert.Nil(err)
+	assert.Equal(3, calls)
+}
+
+func TestFailureTrackerRetriesServerErrors(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	tracker := newTestFailureTracker(&now)
+
+	calls := 0
+	err := tracker.Do("role", "role+policy", func() error {
+		calls++
+		return awserr.NewRequestFailure(awserr.New("InternalFailure", "", nil), 503, "")
+	})
+
+	assert.NotNil(err)
+	assert.Equal(tracker.maxAttempts, calls)
+}
+
+func TestFailureTrackerAttemptsOnce(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	tracker := newTestFailureTracker(&now)
+	tracker.maxAttempts = 0
+
+	calls := 0
+	err := tracker.Do("role", "role+policy", func() error {
+		calls++
+		return awserr.NewRequestFailure(awserr.New("InternalFailure", "", nil), 503, "")
+	})
+
+	assert.NotNil(err)
+	assert.Equal(1, calls)
+}
+
+func TestFailureTrackerDoesNotRetryUnknownErrors(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	tracker := newTestFailureTracker(&now)
+
+	calls := 0
+	err := tracker.Do("role", "role+policy", func() error {
+		calls++
+		return errors.New("unknown")
+	})
+
+	assert.NotNil(err)
+	assert.Equal(1, calls)
+}
+
+func TestFailureTrackerNegativeCache(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	tracker := newTestFailureTracker(&now)
+
+	calls := 0
+	accessDenied := awserr.NewRequestFailure(awserr.New("AccessDenied", "Not authorized", nil), 403, "")
+	fn := func() error {
+		calls++
+		return accessDenied
+	}
+
+	assert.Equal(accessDenied, tracker.Do("role", "role+policy", fn))
+	assert.Equal(accessDenied, tracker.Do("role", "role+policy", fn))
+	assert.Equal(1, calls)
+
+	// Different policy for the same role is not cached
+	assert.Equal(accessDenied, tracker.Do("role", "role+other", fn))
+	assert.Equal(2, calls)
+
+	now = now.Add(tracker.negativeCacheTTL + time.Second)
+	assert.Equal(accessDenied, tracker.Do("role", "role+policy", fn))
+	assert.Equal(3, calls)
+}
+
+func TestFailureTrackerCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	tracker := newTestFailureTracker(&now)
+	tracker.maxAttempts = 1
+
+	calls := 0
+	fail := func() error {
+		calls++
+		return awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "", nil), 503, "")
+	}
+
+	for i := 0; i < tracker.breakerThreshold; i++ {
+		assert.NotNil(tracker.Do("role", "role+policy", fail))
+	}
+
+	assert.Equal(tracker.breakerThreshold, calls)
+	assert.Equal(errCircuitOpen, tracker.Do("role", "role+policy", fail))
+	assert.Equal(tracker.breakerThreshold, calls)
+
+	// Other roles are not affected
+	assert.Nil(tracker.Do("other-role", "other-role+policy", func() error { return nil }))
+
+	now = now.Add(tracker.breakerCooldown + time.Second)
+	assert.Nil(tracker.Do("role", "role+policy", func() error { return nil }))
+	assert.Nil(tracker.Do("role", "role+policy", func() error { return nil }))
+}
@@ -2,12 +2,21 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"path"
 	"regexp"
+	"strings"
 	"time"
 )
 
 var (
-	roleArnRegex = regexp.MustCompile(`^arn:aws:iam::(\d+):role/([^:]+/)?([^:]+?)$`)
+	roleArnRegex = regexp.MustCompile(`^arn:(aws|aws-cn|aws-us-gov|aws-iso|aws-iso-b):iam::(\d{12}):role/([^:]+/)?([^:/]+)$`)
+
+	// matches a role name with an optional path, e.g. team/my-app
+	roleNameRegex = regexp.MustCompile(`^([\w+=,.@-]+/)*[\w+=,.@-]+$`)
+
+	// Used to expand role names to role ARNs. Set when the proxy starts.
+	roleDefaults roleNameDefaults
 )
 
 type roleArn struct {
@@ -15,6 +24,7 @@ type roleArn struct {
 	path      string
 	name      string
 	accountID string
+	partition string
 }
 
 func newRoleArn(value string) (roleArn, error) {
@@ -24,7 +34,38 @@ func newRoleArn(value string) (roleArn, error) {
 		return roleArn{}, errors.New("invalid role ARN")
 	}
 
-	return roleArn{value, "/" + result[2], result[3], result[1]}, nil
+	return roleArn{value, "/" + result[3], result[4], result[2], result[1]}, nil
+}
+
+// roleNameDefaults are the account and partition of roles that are given by
+// name instead of ARN.
+type roleNameDefaults struct {
+	AccountID string
+	Partition string
+}
+
+// Parse returns the role ARN for a role ARN or a role name with an optional
+// path, such as my-app or team/my-app.
+func (d roleNameDefaults) Parse(value string) (roleArn, error) {
+	if strings.HasPrefix(value, "arn:") {
+		return newRoleArn(value)
+	}
+
+	if !roleNameRegex.MatchString(value) {
+		return roleArn{}, errors.New("invalid role name")
+	}
+
+	if len(d.AccountID) == 0 {
+		return roleArn{}, fmt.Errorf("role name %s requires a default role account", value)
+	}
+
+	partition := d.Partition
+
+	if len(partition) == 0 {
+		partition = "aws"
+	}
+
+	return newRoleArn(fmt.Sprintf("arn:%s:iam::%s:role/%s", partition, d.AccountID, value))
 }
 
 func (r roleArn) RoleName() string {
@@ -39,6 +80,10 @@ func (r roleArn) AccountID() string {
 	return r.accountID
 }
 
+func (r roleArn) Partition() string {
+	return r.partition
+}
+
 func (r roleArn) String() string {
 	return r.value
 }
@@ -51,6 +96,114 @@ func (r roleArn) Equals(other roleArn) bool {
 	return r.value == other.value
 }
 
+// newRoleList parses role ARNs or names separated by commas or whitespace. The role
+// names must be unique, because roles are selected by name.
+func newRoleList(value string) ([]roleArn, error) {
+	var roles []roleArn
+	names := make(map[string]bool)
+
+	for _, field := range splitACLPatterns(value) {
+		role, err := roleDefaults.Parse(field)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid role ARN %s: %s", field, err)
+		}
+
+		if names[role.RoleName()] {
+			return nil, fmt.Errorf("Duplicate role name %s", role.RoleName())
+		}
+
+		names[role.RoleName()] = true
+		roles = append(roles, role)
+	}
+
+	return roles, nil
+}
+
+// rolePatterns are glob patterns of the role ARNs that containers can use.
+type rolePatterns []string
+
+// Allowed returns true if there are no patterns or the role matches a pattern.
+func (p rolePatterns) Allowed(role roleArn) bool {
+	if len(p) == 0 {
+		return true
+	}
+
+	for _, pattern := range p {
+		if matched, _ := path.Match(pattern, role.String()); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// roleChainLink is a role that is assumed with the credentials of the previous
+// role in a chain.
+type roleChainLink struct {
+	RoleArn    roleArn
+	ExternalID string
+}
+
+func (l roleChainLink) String() string {
+	if len(l.ExternalID) > 0 {
+		return l.RoleArn.String() + "#" + l.ExternalID
+	}
+
+	return l.RoleArn.String()
+}
+
+type roleChain []roleChainLink
+
+// newRoleChain parses a whitespace separated list of role ARNs or names. Each role
+// may be followed by # and the external id to use when assuming the role.
+func newRoleChain(value string) (roleChain, error) {
+	var chain roleChain
+
+	for _, link := range strings.Fields(value) {
+		parts := strings.SplitN(link, "#", 2)
+		arn, err := roleDefaults.Parse(parts[0])
+
+		if err != nil {
+			return nil, err
+		}
+
+		externalID := ""
+
+		if len(parts) > 1 {
+			externalID = parts[1]
+		}
+
+		chain = append(chain, roleChainLink{arn, externalID})
+	}
+
+	return chain, nil
+}
+
+func (c roleChain) String() string {
+	links := make([]string, len(c))
+
+	for i, link := range c {
+		links[i] = link.String()
+	}
+
+	return strings.Join(links, " ")
+}
+
+func (c roleChain) Equals(other roleChain) bool {
+	if len(c) != len(other) {
+		return false
+	}
+
+	for i := range c {
+		if c[i] != other[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
 type roleCredentials struct {
 	AccessKey  string
 	SecretKey  string
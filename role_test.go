@@ -27,3 +27,90 @@ func TestNewRoleArnWithPath(t *testing.T) {
 	assert.Equal("123456789012", arn.AccountID())
 	assert.Equal("arn:aws:iam::123456789012:role/this/is/the/path/test-role-name", arn.String())
 }
+
+func TestNewRoleChain(t *testing.T) {
+	assert := assert.New(t)
+
+	chain, err := newRoleChain(" arn:aws:iam::123456789012:role/hub#hub-external-id\n arn:aws:iam::210987654321:role/path/workload ")
+	assert.Nil(err)
+	assert.Equal(2, len(chain))
+	assert.Equal("arn:aws:iam::123456789012:role/hub", chain[0].RoleArn.String())
+	assert.Equal("hub-external-id", chain[0].ExternalID)
+	assert.Equal("arn:aws:iam::210987654321:role/path/workload", chain[1].RoleArn.String())
+	assert.Equal("", chain[1].ExternalID)
+	assert.Equal("arn:aws:iam::123456789012:role/hub#hub-external-id arn:aws:iam::210987654321:role/path/workload", chain.String())
+
+	other, err := newRoleChain(chain.String())
+	assert.Nil(err)
+	assert.True(chain.Equals(other))
+	assert.False(chain.Equals(other[:1]))
+
+	_, err = newRoleChain("arn:aws:iam::123456789012:role/hub not-an-arn")
+	assert.NotNil(err)
+}
+
+func TestNewRoleArnPartitions(t *testing.T) {
+	tests := []struct {
+		value     string
+		partition string
+		valid     bool
+	}{
+		{"arn:aws:iam::123456789012:role/app", "aws", true},
+		{"arn:aws-cn:iam::123456789012:role/app", "aws-cn", true},
+		{"arn:aws-us-gov:iam::123456789012:role/path/app", "aws-us-gov", true},
+		{"arn:aws-iso:iam::123456789012:role/app", "aws-iso", true},
+		{"arn:aws-iso-b:iam::123456789012:role/app", "aws-iso-b", true},
+		{"arn:aws-other:iam::123456789012:role/app", "", false},
+		{"arn:aws:iam::123456789012:user/app", "", false},
+		{"arn:aws:iam::1234:role/app", "", false},
+		{"arn:aws:iam::123456789012:role/", "", false},
+	}
+
+	for _, test := range tests {
+		arn, err := newRoleArn(test.value)
+
+		if !test.valid {
+			assert.NotNil(t, err, test.value)
+			continue
+		}
+
+		assert.Nil(t, err, test.value)
+		assert.Equal(t, test.partition, arn.Partition(), test.value)
+		assert.Equal(t, "app", arn.RoleName(), test.value)
+		assert.Equal(t, test.value, arn.String(), test.value)
+	}
+}
+
+func TestRoleNameDefaultsParse(t *testing.T) {
+	tests := []struct {
+		defaults roleNameDefaults
+		value    string
+		expected string
+	}{
+		{roleNameDefaults{"123456789012", "aws"}, "my-app", "arn:aws:iam::123456789012:role/my-app"},
+		{roleNameDefaults{"123456789012", "aws"}, "team/my-app", "arn:aws:iam::123456789012:role/team/my-app"},
+		{roleNameDefaults{"123456789012", "aws-cn"}, "my-app", "arn:aws-cn:iam::123456789012:role/my-app"},
+		{roleNameDefaults{"123456789012", "aws-us-gov"}, "a/b/my-app", "arn:aws-us-gov:iam::123456789012:role/a/b/my-app"},
+		{roleNameDefaults{"123456789012", ""}, "my-app", "arn:aws:iam::123456789012:role/my-app"},
+		{roleNameDefaults{"123456789012", "aws"}, "arn:aws-cn:iam::210987654321:role/other", "arn:aws-cn:iam::210987654321:role/other"},
+		{roleNameDefaults{"", ""}, "arn:aws:iam::210987654321:role/other", "arn:aws:iam::210987654321:role/other"},
+		// Invalid
+		{roleNameDefaults{"", "aws"}, "my-app", ""},
+		{roleNameDefaults{"123456789012", "aws"}, "team//my-app", ""},
+		{roleNameDefaults{"123456789012", "aws"}, "/my-app", ""},
+		{roleNameDefaults{"123456789012", "aws"}, "my app", ""},
+		{roleNameDefaults{"123456789012", "aws"}, "arn:aws:iam::123456789012:my-app", ""},
+	}
+
+	for _, test := range tests {
+		arn, err := test.defaults.Parse(test.value)
+
+		if len(test.expected) == 0 {
+			assert.NotNil(t, err, test.value)
+			continue
+		}
+
+		assert.Nil(t, err, test.value)
+		assert.Equal(t, test.expected, arn.String(), test.value)
+	}
+}
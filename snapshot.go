@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	// Header added to the responses served from the snapshot
+	snapshotHeader = "X-Ec2metaproxy-Snapshot"
+)
+
+var (
+	// Paths, relative to meta-data like override keys, that do not change
+	// while the instance runs and are kept in the snapshot. Credentials, user
+	// data, tags and events are never kept.
+	snapshotPaths = []string{
+		"ami-id",
+		"ami-launch-index",
+		"block-device-mapping",
+		"hostname",
+		"instance-id",
+		"instance-type",
+		"local-hostname",
+		"local-ipv4",
+		"mac",
+		"network/interfaces/macs",
+		"placement",
+		"public-hostname",
+		"public-ipv4",
+		"reservation-id",
+		"services/domain",
+		"services/partition",
+		"dynamic/instance-identity/document",
+	}
+
+	// Metadata values captured when the proxy starts
+	snapshotCapturePaths = []string{
+		"meta-data/",
+		"meta-data/ami-id",
+		"meta-data/hostname",
+		"meta-data/instance-id",
+		"meta-data/instance-type",
+		"meta-data/local-hostname",
+		"meta-data/local-ipv4",
+		"meta-data/mac",
+		"meta-data/placement/availability-zone",
+		"meta-data/placement/region",
+		"dynamic/instance-identity/document",
+	}
+)
+
+type snapshotValue struct {
+	ContentType string `json:"content_type"`
+	Body        string `json:"body"`
+}
+
+// metadataSnapshot keeps the last known value of static metadata paths, so
+// they can be served when the EC2 metadata service is unavailable. Values are
+// keyed by path relative to the API version.
+type metadataSnapshot struct {
+	file   string
+	values map[string]snapshotValue
+	lock   sync.Mutex
+	// Number of responses served from the snapshot
+	served int64
+}
+
+// newMetadataSnapshot creates a snapshot that is persisted to file, if file is
+// set. The values in the file are loaded if the file exists.
+func newMetadataSnapshot(file string) (*metadataSnapshot, error) {
+	snapshot := &metadataSnapshot{
+		file:   file,
+		values: make(map[string]snapshotValue),
+	}
+
+	if len(file) == 0 {
+		return snapshot, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+
+	if os.IsNotExist(err) {
+		return snapshot, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &snapshot.values); err != nil {
+		log.Warn("Ignoring invalid metadata snapshot file ", file, ": ", err)
+	}
+
+	return snapshot, nil
+}
+
+// snapshotEligible returns true if the path can be served from the snapshot:
+// the meta-data listing and snapshotPaths.
+func snapshotEligible(subpath string) bool {
+	subpath = strings.Trim(subpath, "/")
+
+	if subpath == "meta-data" {
+		return true
+	}
+
+	for _, path := range snapshotPaths {
+		if aclMatch(overridePath(path), subpath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Record updates the value of the path.
+func (s *metadataSnapshot) Record(subpath, contentType string, body []byte) {
+	if !snapshotEligible(subpath) {
+		return
+	}
+
+	value := snapshotValue{contentType, string(body)}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.values[subpath] == value {
+		return
+	}
+
+	s.values[subpath] = value
+
+	if len(s.file) > 0 {
+		if err := s.save(); err != nil {
+			log.Warn("Error saving metadata snapshot to ", s.file, ": ", err)
+		}
+	}
+}
+
+// save writes the snapshot to the file. The lock must be held.
+func (s *metadataSnapshot) save() error {
+	data, err := json.Marshal(s.values)
+
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.file), ".snapshot")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.file)
+}
+
+// Response returns a response with the snapshot value of the path.
+func (s *metadataSnapshot) Response(subpath string) (*http.Response, bool) {
+	s.lock.Lock()
+	value, found := s.values[subpath]
+	s.lock.Unlock()
+
+	if !found {
+		return nil, false
+	}
+
+	atomic.AddInt64(&s.served, 1)
+
+	header := http.Header{snapshotHeader: {"true"}}
+
+	if len(value.ContentType) > 0 {
+		header.Set("Content-Type", value.ContentType)
+	}
+
+	return &http.Response{
+		Status:        http.StatusText(http.StatusOK),
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(value.Body)),
+		ContentLength: int64(len(value.Body)),
+	}, true
+}
+
+// TokenResponse returns an IMDSv2 token that the proxy issues itself while the
+// metadata service is unavailable. The metadata service rejects the token once
+// it is available again and clients request a new token.
+func (s *metadataSnapshot) TokenResponse(r *http.Request) (*http.Response, error) {
+	data := make([]byte, 32)
+
+	if _, err := rand.Read(data); err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt64(&s.served, 1)
+	token := base64.StdEncoding.EncodeToString(data)
+
+	header := http.Header{
+		snapshotHeader:                         {"true"},
+		"Content-Type":                         {"text/plain"},
+		"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds")},
+	}
+
+	return &http.Response{
+		Status:        http.StatusText(http.StatusOK),
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader([]byte(token))),
+		ContentLength: int64(len(token)),
+	}, nil
+}
+
+// Served returns the number of responses served from the snapshot.
+func (s *metadataSnapshot) Served() int64 {
+	return atomic.LoadInt64(&s.served)
+}
+
+// snapshotStats describes the snapshot for the admin API.
+type snapshotStats struct {
+	Paths  int   `json:"paths"`
+	Served int64 `json:"served"`
+}
+
+// Stats returns the number of paths in the snapshot and the number of
+// responses served from it.
+func (s *metadataSnapshot) Stats() snapshotStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return snapshotStats{len(s.values), s.Served()}
+}
+
+// Capture records the values of snapshotCapturePaths. fetch gets a path
+// relative to the metadata service root.
+func (s *metadataSnapshot) Capture(fetch func(path string) (string, error)) {
+	for _, subpath := range snapshotCapturePaths {
+		value, err := fetch("/latest/" + subpath)
+
+		if err != nil {
+			log.Warn("Error capturing ", subpath, " for the metadata snapshot: ", err)
+			continue
+		}
+
+		s.Record(subpath, "text/plain", []byte(value))
+	}
+}
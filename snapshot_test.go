@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadataSnapshotEligible(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(snapshotEligible("meta-data/instance-id"))
+	assert.True(snapshotEligible("meta-data/placement/region"))
+	assert.True(snapshotEligible("meta-data/placement/"))
+	assert.True(snapshotEligible("meta-data/"))
+	assert.True(snapshotEligible("meta-data/network/interfaces/macs/02:42:ac:11:00:02/subnet-id"))
+	assert.True(snapshotEligible("dynamic/instance-identity/document"))
+	assert.False(snapshotEligible("user-data"))
+	assert.False(snapshotEligible("meta-data/iam/security-credentials/role"))
+	assert.False(snapshotEligible("meta-data/identity-credentials/ec2/security-credentials/ec2-instance"))
+	assert.False(snapshotEligible("meta-data/spot/instance-action"))
+	assert.False(snapshotEligible("meta-data/tags/instance/Name"))
+	assert.False(snapshotEligible("meta-data/public-keys/0/openssh-key"))
+	assert.False(snapshotEligible("meta-data/instance-idx"))
+	assert.False(snapshotEligible("dynamic/instance-identity/signature"))
+	assert.False(snapshotEligible("api/token"))
+}
+
+func TestMetadataProxySnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "snapshot")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	available := true
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/latest/meta-data/instance-id":
+			w.Write([]byte("i-1234"))
+		case "/latest/user-data":
+			w.Write([]byte("secret"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	file := filepath.Join(dir, "snapshot.json")
+	snapshot, err := newMetadataSnapshot(file)
+	assert.Nil(err)
+
+	proxy := newMetadataProxy(upstream.URL, &http.Transport{}, testContainerService{}, newTestConfig())
+	proxy.snapshot = snapshot
+
+	ttl := "X-aws-ec2-metadata-token-ttl-seconds: 21600"
+
+	assert.Equal("i-1234", testRequest(proxy.Handle, "GET", "/latest/meta-data/instance-id", "172.17.0.2", ttl).Body.String())
+	assert.Equal("secret", testRequest(proxy.Handle, "GET", "/latest/user-data", "172.17.0.2", ttl).Body.String())
+
+	available = false
+
+	w := testRequest(proxy.Handle, "GET", "/latest/meta-data/instance-id", "172.17.0.2", ttl)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("i-1234", w.Body.String())
+	assert.Equal("true", w.Header().Get(snapshotHeader))
+
+	assert.Equal(http.StatusServiceUnavailable, testRequest(proxy.Handle, "GET", "/latest/user-data", "172.17.0.2", ttl).Code)
+
+	w = testRequest(proxy.Handle, "PUT", "/latest/api/token", "172.17.0.2", ttl)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.NotEmpty(w.Body.String())
+	assert.Equal("21600", w.Header().Get("X-aws-ec2-metadata-token-ttl-seconds"))
+	assert.Equal(int64(2), snapshot.Served())
+	assert.Equal(snapshotStats{Paths: 1, Served: 2}, snapshot.Stats())
+
+	// The snapshot is loaded from the file
+	snapshot, err = newMetadataSnapshot(file)
+	assert.Nil(err)
+	proxy.snapshot = snapshot
+	assert.Equal("i-1234", testRequest(proxy.Handle, "GET", "/latest/meta-data/instance-id", "172.17.0.2", ttl).Body.String())
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticCredentialSource(t *testing.T) {
+	assert := assert.New(t)
+
+	role, _ := newRoleArn("arn:aws:iam::123456789012:role/app")
+	source := newStaticCredentialSource("AKID", "SECRET", "TOKEN")
+
+	creds, err := source.Credentials(credentialsRequest{Role: roleChainLink{RoleArn: role}, Duration: time.Hour})
+	assert.Nil(err)
+	assert.Equal("AKID", creds.AccessKey)
+	assert.Equal("SECRET", creds.SecretKey)
+	assert.Equal("TOKEN", creds.Token)
+	assert.Equal(role, creds.RoleArn)
+	assert.Equal(time.Hour, creds.Expiration.Sub(creds.GeneratedAt))
+	assert.False(creds.ExpiresIn(sessionExpiration))
+}
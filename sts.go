@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awscredentials "github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	log "github.com/cihub/seelog"
+)
+
+type stsOptions struct {
+	Region   string
+	Endpoint string
+	FIPS     bool
+	CABundle string
+}
+
+func newSTSClient(awsSession *session.Session, opts stsOptions) (*sts.STS, error) {
+	// Retries are handled by the credentials provider
+	config := aws.NewConfig().WithMaxRetries(0)
+
+	region := opts.Region
+
+	if len(region) == 0 && len(opts.Endpoint) == 0 {
+		instanceRegion, err := instanceRegion()
+
+		if err != nil {
+			return nil, fmt.Errorf("Unable to determine instance region, set --sts-region or --sts-endpoint: %s", err)
+		}
+
+		region = instanceRegion
+	}
+
+	endpoint := opts.Endpoint
+
+	if len(endpoint) > 0 && opts.FIPS {
+		return nil, errors.New("The STS FIPS endpoint can not be used with a custom STS endpoint")
+	} else if len(endpoint) == 0 && len(region) > 0 {
+		endpoint = stsEndpoint(region, opts.FIPS)
+	} else if len(endpoint) == 0 && opts.FIPS {
+		return nil, errors.New("STS region is required for the FIPS endpoint")
+	}
+
+	if len(region) > 0 {
+		config.WithRegion(region)
+	}
+
+	if len(endpoint) > 0 {
+		config.WithEndpoint(endpoint)
+	}
+
+	if len(opts.CABundle) > 0 {
+		client, err := newCABundleClient(opts.CABundle)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.WithHTTPClient(client)
+	}
+
+	log.Infof("STS region=%s endpoint=%s", region, endpoint)
+	return sts.New(awsSession, config), nil
+}
+
+// lazySTSClient creates the STS client when it is first used, so the proxy
+// starts without an STS region if no container uses STS. Errors are not
+// cached, so a failed region lookup is retried by the next request.
+type lazySTSClient struct {
+	create func() (*sts.STS, error)
+	client *sts.STS
+	lock   sync.Mutex
+}
+
+func newLazySTSClient(create func() (*sts.STS, error)) *lazySTSClient {
+	return &lazySTSClient{create: create}
+}
+
+func (c *lazySTSClient) Client() (*sts.STS, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.client == nil {
+		client, err := c.create()
+
+		if err != nil {
+			return nil, err
+		}
+
+		c.client = client
+	}
+
+	return c.client, nil
+}
+
+// stsCredentialSource assumes the container role with STS using the instance
+// profile credentials.
+type stsCredentialSource struct {
+	awsSts           *lazySTSClient
+	failures         *failureTracker
+	chainCredentials map[string]credentials
+	lock             sync.Mutex
+}
+
+func newSTSCredentialSource(awsSts *lazySTSClient, failures *failureTracker) *stsCredentialSource {
+	return &stsCredentialSource{
+		awsSts:           awsSts,
+		failures:         failures,
+		chainCredentials: make(map[string]credentials),
+	}
+}
+
+func (c *stsCredentialSource) Credentials(req credentialsRequest) (credentials, error) {
+	return c.AssumeRole(req.Platform, req.RoleChain, req.Role, req.IamPolicy, req.SessionName, req.Duration)
+}
+
+// AssumeRole assumes each role in the chain, in order, and then assumes the
+// given role with the credentials of the last role in the chain. Credentials
+// for the roles in the chain are cached and shared by all containers. The lock
+// is not held during requests to STS, which may be retried with a backoff.
+func (c *stsCredentialSource) AssumeRole(platform string, chain roleChain, role roleChainLink, iamPolicy, sessionName string, duration time.Duration) (credentials, error) {
+	instanceSts, err := c.awsSts.Client()
+
+	if err != nil {
+		return credentials{}, err
+	}
+
+	awsSts := instanceSts
+
+	for i, link := range chain {
+		key := chain[:i+1].String()
+
+		c.lock.Lock()
+		linkCredentials, found := c.chainCredentials[key]
+		c.lock.Unlock()
+
+		if !found || linkCredentials.ExpiresIn(sessionExpiration) {
+			newCredentials, err := c.assumeRole(awsSts, chain[:i], link, "", generateSessionName(platform, "role-chain"), duration)
+
+			if err != nil && (!found || linkCredentials.ExpiredNow()) {
+				return credentials{}, fmt.Errorf("Error assuming role %s in role chain: %s", link.RoleArn, err)
+			} else if err != nil {
+				log.Warnf("Error renewing credentials for role %s in role chain, using existing credentials that expire at %s: %s", link.RoleArn, linkCredentials.Expiration, err)
+			} else {
+				linkCredentials = newCredentials
+
+				c.lock.Lock()
+				c.chainCredentials[key] = linkCredentials
+				c.lock.Unlock()
+			}
+		}
+
+		awsSts = stsWithCredentials(instanceSts, linkCredentials)
+	}
+
+	return c.assumeRole(awsSts, chain, role, iamPolicy, sessionName, duration)
+}
+
+// assumeRole assumes the role with the credentials of the last role in chain,
+// or the instance profile if chain is empty.
+func (c *stsCredentialSource) assumeRole(awsSts *sts.STS, chain roleChain, role roleChainLink, iamPolicy, sessionName string, duration time.Duration) (credentials, error) {
+	var policy *string
+
+	if len(iamPolicy) > 0 {
+		policy = aws.String(iamPolicy)
+	}
+
+	var externalID *string
+
+	if len(role.ExternalID) > 0 {
+		externalID = aws.String(role.ExternalID)
+	}
+
+	var resp *sts.AssumeRoleOutput
+	roleArn := role.RoleArn
+
+	// A permanent failure only applies to requests through the same chain with
+	// the same external ids and policy
+	cacheKey := chain.String() + "\x00" + role.String() + "\x00" + iamPolicy
+
+	err := c.failures.Do(roleArn.String(), cacheKey, func() (err error) {
+		resp, err = awsSts.AssumeRole(&sts.AssumeRoleInput{
+			DurationSeconds: aws.Int64(int64(duration / time.Second)),
+			ExternalId:      externalID,
+			Policy:          policy,
+			RoleArn:         aws.String(roleArn.String()),
+			RoleSessionName: aws.String(sessionName),
+		})
+		return
+	})
+
+	if err != nil {
+		return credentials{}, err
+	}
+
+	return credentials{
+		AccessKey:   *resp.Credentials.AccessKeyId,
+		SecretKey:   *resp.Credentials.SecretAccessKey,
+		Token:       *resp.Credentials.SessionToken,
+		Expiration:  *resp.Credentials.Expiration,
+		GeneratedAt: time.Now(),
+		RoleArn:     roleArn,
+	}, nil
+}
+
+// stsWithCredentials returns a client that uses the same endpoint as base but
+// signs requests with the given credentials.
+func stsWithCredentials(base *sts.STS, creds credentials) *sts.STS {
+	config := base.Client.Config.Copy().
+		WithCredentials(awscredentials.NewStaticCredentials(creds.AccessKey, creds.SecretKey, creds.Token))
+
+	return sts.New(session.New(config))
+}
+
+// regionPartition returns the AWS partition of the region.
+func regionPartition(region string) string {
+	switch {
+	case strings.HasPrefix(region, "cn-"):
+		return "aws-cn"
+	case strings.HasPrefix(region, "us-gov-"):
+		return "aws-us-gov"
+	case strings.HasPrefix(region, "us-iso-"):
+		return "aws-iso"
+	case strings.HasPrefix(region, "us-isob-"):
+		return "aws-iso-b"
+	default:
+		return "aws"
+	}
+}
+
+// stsEndpoint returns the regional STS endpoint for the region.
+func stsEndpoint(region string, fips bool) string {
+	dnsSuffix := "amazonaws.com"
+
+	switch regionPartition(region) {
+	case "aws-cn":
+		dnsSuffix = "amazonaws.com.cn"
+	case "aws-iso":
+		dnsSuffix = "c2s.ic.gov"
+	case "aws-iso-b":
+		dnsSuffix = "sc2s.sgov.gov"
+	}
+
+	// The regular GovCloud endpoints are FIPS endpoints
+	if fips && !strings.HasPrefix(region, "us-gov-") {
+		return fmt.Sprintf("https://sts-fips.%s.%s", region, dnsSuffix)
+	}
+
+	return fmt.Sprintf("https://sts.%s.%s", region, dnsSuffix)
+}
+
+func newCABundleClient(path string) (*http.Client, error) {
+	pem, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	certs := x509.NewCertPool()
+
+	if !certs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in CA bundle %s", path)
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: certs},
+		},
+	}, nil
+}
+
+// instanceRegion returns the region of the EC2 instance from the instance
+// placement metadata.
+func instanceRegion() (string, error) {
+	region, err := fetchMetadata("/latest/meta-data/placement/region")
+
+	if err == nil && len(region) > 0 {
+		return region, nil
+	}
+
+	// Older metadata service versions only provide the availability zone
+	zone, err := fetchMetadata("/latest/meta-data/placement/availability-zone")
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(zone) < 2 {
+		return "", fmt.Errorf("Invalid availability zone: %s", zone)
+	}
+
+	return zone[:len(zone)-1], nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awscredentials "github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSTSEndpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		region   string
+		fips     bool
+		endpoint string
+	}{
+		{"us-east-1", false, "https://sts.us-east-1.amazonaws.com"},
+		{"us-east-1", true, "https://sts-fips.us-east-1.amazonaws.com"},
+		{"eu-west-1", false, "https://sts.eu-west-1.amazonaws.com"},
+		{"cn-north-1", false, "https://sts.cn-north-1.amazonaws.com.cn"},
+		{"cn-northwest-1", true, "https://sts-fips.cn-northwest-1.amazonaws.com.cn"},
+		// The regular GovCloud endpoints are FIPS endpoints
+		{"us-gov-west-1", false, "https://sts.us-gov-west-1.amazonaws.com"},
+		{"us-gov-west-1", true, "https://sts.us-gov-west-1.amazonaws.com"},
+		{"us-iso-east-1", false, "https://sts.us-iso-east-1.c2s.ic.gov"},
+		{"us-iso-east-1", true, "https://sts-fips.us-iso-east-1.c2s.ic.gov"},
+		{"us-isob-east-1", false, "https://sts.us-isob-east-1.sc2s.sgov.gov"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(test.endpoint, stsEndpoint(test.region, test.fips), "%s fips=%v", test.region, test.fips)
+	}
+}
+
+func TestRegionPartition(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("aws", regionPartition("us-east-1"))
+	assert.Equal("aws-cn", regionPartition("cn-north-1"))
+	assert.Equal("aws-us-gov", regionPartition("us-gov-east-1"))
+	assert.Equal("aws-iso", regionPartition("us-iso-west-1"))
+	assert.Equal("aws-iso-b", regionPartition("us-isob-east-1"))
+}
+
+func TestNewSTSClient(t *testing.T) {
+	assert := assert.New(t)
+
+	client, err := newSTSClient(session.New(), stsOptions{Region: "us-west-2", FIPS: true})
+	assert.Nil(err)
+	assert.Equal("https://sts-fips.us-west-2.amazonaws.com", client.Endpoint)
+
+	client, err = newSTSClient(session.New(), stsOptions{Endpoint: "https://sts.example.com"})
+	assert.Nil(err)
+	assert.Equal("https://sts.example.com", client.Endpoint)
+
+	// The FIPS endpoint is chosen by region
+	_, err = newSTSClient(session.New(), stsOptions{Region: "us-west-2", Endpoint: "https://sts.example.com", FIPS: true})
+	assert.NotNil(err)
+}
+
+func TestNewCABundleClient(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "ec2metaproxy")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	bundle := filepath.Join(dir, "ca.pem")
+	assert.Nil(ioutil.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600))
+
+	client, err := newCABundleClient(bundle)
+	assert.Nil(err)
+
+	resp, err := client.Get(server.URL)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+
+	// The certificate is only trusted with the bundle
+	_, err = (&http.Client{Transport: &http.Transport{}}).Get(server.URL)
+	assert.NotNil(err)
+
+	empty := filepath.Join(dir, "empty.pem")
+	assert.Nil(ioutil.WriteFile(empty, []byte("not a certificate"), 0600))
+	_, err = newCABundleClient(empty)
+	assert.NotNil(err)
+
+	_, err = newCABundleClient(filepath.Join(dir, "missing.pem"))
+	assert.NotNil(err)
+}
+
+var stsAccessKeyRegexp = regexp.MustCompile(`Credential=([^/]+)/`)
+
+// newFakeSTS returns an STS client for a server that answers AssumeRole and
+// AssumeRoleWithWebIdentity requests with respond, which gets the form of the
+// request and the access key it was signed with. The credentials it returns
+// have the access key AKID-<role name>.
+func newFakeSTS(t *testing.T, respond func(form map[string]string, accessKey string) error) *sts.STS {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form := make(map[string]string)
+
+		for key := range r.PostForm {
+			form[key] = r.PostForm.Get(key)
+		}
+
+		accessKey := ""
+
+		if match := stsAccessKeyRegexp.FindStringSubmatch(r.Header.Get("Authorization")); match != nil {
+			accessKey = match[1]
+		}
+
+		if err := respond(form, accessKey); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "<ErrorResponse><Error><Type>Sender</Type><Code>AccessDenied</Code><Message>%s</Message></Error><RequestId>1</RequestId></ErrorResponse>", err)
+			return
+		}
+
+		roleName := form["RoleArn"][strings.LastIndex(form["RoleArn"], "/")+1:]
+		fmt.Fprintf(w, "<%[1]sResponse><%[1]sResult><Credentials><AccessKeyId>AKID-%[2]s</AccessKeyId><SecretAccessKey>SECRET</SecretAccessKey><SessionToken>TOKEN</SessionToken><Expiration>%[3]s</Expiration></Credentials></%[1]sResult></%[1]sResponse>",
+			form["Action"], roleName, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	t.Cleanup(server.Close)
+
+	return sts.New(session.New(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: awscredentials.NewStaticCredentials("AKID-instance", "SECRET", ""),
+	}))
+}
+
+func TestSTSNegativeCacheKey(t *testing.T) {
+	assert := assert.New(t)
+
+	calls := 0
+	awsSts := newFakeSTS(t, func(form map[string]string, accessKey string) error {
+		if strings.HasSuffix(form["RoleArn"], "/app") {
+			calls++
+
+			// The app role only trusts hub-b and the external id "valid"
+			if accessKey != "AKID-hub-b" || form["ExternalId"] != "valid" {
+				return fmt.Errorf("Not authorized for %s", accessKey)
+			}
+		}
+
+		return nil
+	})
+	source := newSTSCredentialSource(newLazySTSClient(func() (*sts.STS, error) { return awsSts, nil }), newFailureTracker())
+
+	app, _ := newRoleArn("arn:aws:iam::123456789012:role/app")
+	hubA, _ := newRoleChain("arn:aws:iam::123456789012:role/hub-a")
+	hubB, _ := newRoleChain("arn:aws:iam::123456789012:role/hub-b")
+
+	assumeApp := func(chain roleChain, externalID string) error {
+		_, err := source.AssumeRole("test", chain, roleChainLink{app, externalID}, "", "session", time.Hour)
+		return err
+	}
+
+	assert.NotNil(assumeApp(hubA, "valid"))
+	assert.NotNil(assumeApp(hubA, "valid"))
+	assert.Equal(1, calls)
+
+	// A permanent failure through another chain or with another external id
+	// is not served to requests through a valid chain
+	assert.NotNil(assumeApp(hubB, "other"))
+	assert.Equal(2, calls)
+	assert.Nil(assumeApp(hubB, "valid"))
+	assert.Equal(3, calls)
+}
+
+func TestLazySTSClient(t *testing.T) {
+	assert := assert.New(t)
+
+	calls := 0
+	var createErr error
+	client := newLazySTSClient(func() (*sts.STS, error) {
+		calls++
+
+		if createErr != nil {
+			return nil, createErr
+		}
+
+		return newSTSClient(session.New(), stsOptions{Region: "us-west-2"})
+	})
+	assert.Equal(0, calls)
+
+	// Errors are not cached
+	createErr = fmt.Errorf("Unable to determine instance region")
+	_, err := client.Client()
+	assert.NotNil(err)
+
+	createErr = nil
+	first, err := client.Client()
+	assert.Nil(err)
+	second, err := client.Client()
+	assert.Nil(err)
+	assert.True(first == second)
+	assert.Equal(2, calls)
+}
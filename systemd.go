@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	// First file descriptor passed by systemd socket activation
+	sdListenFdsStart = 3
+
+	// Name of a socket passed by systemd that is used for the admin API, set
+	// with FileDescriptorName= in the socket unit
+	adminSocketName = "admin"
+
+	sdReady    = "READY=1"
+	sdStopping = "STOPPING=1"
+	sdWatchdog = "WATCHDOG=1"
+
+	// How often to check whether the containers were synchronized before
+	// notifying systemd
+	syncPollInterval = 100 * time.Millisecond
+)
+
+// activatedListeners returns the sockets passed by systemd socket activation,
+// starting at file descriptor firstFd. The socket named admin is returned
+// separately, the others are served by the proxy. There are no sockets if the
+// proxy was not started by socket activation.
+func activatedListeners(firstFd int) ([]net.Listener, net.Listener, error) {
+	pid := os.Getenv("LISTEN_PID")
+	count := os.Getenv("LISTEN_FDS")
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// The sockets are not passed on to other processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if len(count) == 0 || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil, nil
+	}
+
+	n, err := strconv.Atoi(count)
+
+	if err != nil || n < 0 {
+		return nil, nil, fmt.Errorf("Invalid LISTEN_FDS: %s", count)
+	}
+
+	var listeners []net.Listener
+	var admin net.Listener
+
+	for i := 0; i < n; i++ {
+		fd := firstFd + i
+		syscall.CloseOnExec(fd)
+
+		name := fmt.Sprintf("fd%d", fd)
+
+		if i < len(names) && len(names[i]) > 0 {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("Socket %s is not a listening socket: %s", name, err)
+		}
+
+		if name == adminSocketName && admin == nil {
+			admin = listener
+		} else {
+			listeners = append(listeners, listener)
+		}
+	}
+
+	return listeners, admin, nil
+}
+
+// activatedAdminAddr describes the admin socket passed by systemd. A unix
+// socket is described like --admin-server=unix:<path>, so that it does not
+// require the admin token either.
+func activatedAdminAddr(listener net.Listener) string {
+	addr := listener.Addr()
+
+	if addr.Network() == "unix" {
+		return unixAddrPrefix + addr.String()
+	}
+
+	return fmt.Sprintf("systemd socket %s (%s)", adminSocketName, addr)
+}
+
+// sdNotify sends a state to systemd, such as READY=1. It does nothing if the
+// proxy was not started by systemd with Type=notify.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+
+	if len(socket) == 0 {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often watchdog heartbeats are sent, which is
+// half of the timeout set with WatchdogSec=, or 0 if systemd does not expect
+// heartbeats.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// notifySystemd tells systemd that the proxy is ready once the containers were
+// synchronized. It then sends watchdog heartbeats while alive returns nil, so
+// systemd restarts the proxy if it stays dead for longer than WatchdogSec=.
+func notifySystemd(platform containerService, alive func() error) {
+	if len(os.Getenv("NOTIFY_SOCKET")) == 0 {
+		return
+	}
+
+	for !platform.Synced() {
+		time.Sleep(syncPollInterval)
+	}
+
+	if err := sdNotify(sdReady); err != nil {
+		log.Warn("Error notifying systemd: ", err)
+		return
+	}
+
+	interval := watchdogInterval()
+
+	if interval == 0 {
+		return
+	}
+
+	log.Info("Sending watchdog heartbeats every ", interval)
+
+	for range time.Tick(interval) {
+		if err := alive(); err != nil {
+			log.Warn("Skipping watchdog heartbeat: ", err)
+			sdNotify("STATUS=Not alive: " + err.Error())
+			continue
+		}
+
+		if err := sdNotify(sdWatchdog + "\nSTATUS=Alive"); err != nil {
+			log.Warn("Error sending watchdog heartbeat: ", err)
+		}
+	}
+}
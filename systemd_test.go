@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func activatedFd(t *testing.T) (int, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	file, err := listener.(*net.TCPListener).File()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	// The activated socket owns its file descriptor
+	fd, err := syscall.Dup(int(file.Fd()))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fd, listener.Addr().String()
+}
+
+func TestActivatedListeners(t *testing.T) {
+	assert := assert.New(t)
+
+	listeners, admin, err := activatedListeners(sdListenFdsStart)
+	assert.Nil(err)
+	assert.Len(listeners, 0)
+	assert.Nil(admin)
+
+	fd, addr := activatedFd(t)
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+
+	listeners, admin, err = activatedListeners(fd)
+	assert.Nil(err)
+	assert.Nil(admin)
+
+	if assert.Len(listeners, 1) {
+		assert.Equal(addr, listeners[0].Addr().String())
+		listeners[0].Close()
+	}
+
+	// The environment is only used once
+	assert.Equal("", os.Getenv("LISTEN_FDS"))
+
+	fd, addr = activatedFd(t)
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_FDNAMES", adminSocketName)
+
+	listeners, admin, err = activatedListeners(fd)
+	assert.Nil(err)
+	assert.Len(listeners, 0)
+
+	if assert.NotNil(admin) {
+		assert.Equal(addr, admin.Addr().String())
+		admin.Close()
+	}
+
+	// Sockets for another process are ignored
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "1")
+
+	listeners, admin, err = activatedListeners(fd)
+	assert.Nil(err)
+	assert.Len(listeners, 0)
+	assert.Nil(admin)
+}
+
+func TestSdNotify(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(sdNotify(sdReady))
+
+	dir, err := ioutil.TempDir("", "systemd")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	assert.Nil(err)
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	assert.Nil(sdNotify(sdReady))
+
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	assert.Nil(err)
+	assert.Equal(sdReady, string(buf[:n]))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(time.Duration(0), watchdogInterval())
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	assert.Equal(15*time.Second, watchdogInterval())
+
+	os.Setenv("WATCHDOG_PID", "1")
+	defer os.Unsetenv("WATCHDOG_PID")
+	assert.Equal(time.Duration(0), watchdogInterval())
+}
+
+func TestActivatedAdminAddr(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "systemd")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "admin.sock")
+	unixListener, err := net.Listen("unix", path)
+	assert.Nil(err)
+	defer unixListener.Close()
+
+	// An activated unix socket does not require the admin token
+	addr := activatedAdminAddr(unixListener)
+	assert.Equal(unixAddrPrefix+path, addr)
+	token, err := readAdminToken(addr, "")
+	assert.Nil(err)
+	assert.Equal("", token)
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer tcpListener.Close()
+
+	_, err = readAdminToken(activatedAdminAddr(tcpListener), "")
+	assert.NotNil(err)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+
+	log "github.com/cihub/seelog"
+)
+
+type connContextKey struct{}
+
+// withConn stores the connection of a request in the request context, so that
+// handlers can change socket options of the connection.
+func withConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
+// setHopLimit sets the IP TTL, or the IPv6 hop limit, of the responses on the
+// connection of the request. The limit stays on the connection, so the
+// connection must not be reused for other responses.
+func setHopLimit(r *http.Request, hopLimit int) error {
+	conn, ok := r.Context().Value(connContextKey{}).(net.Conn)
+
+	if !ok {
+		return errors.New("Connection of the request is not available")
+	}
+
+	sysConn, ok := conn.(syscall.Conn)
+
+	if !ok {
+		return errors.New("Connection of the request does not support socket options")
+	}
+
+	rawConn, err := sysConn.SyscallConn()
+
+	if err != nil {
+		return err
+	}
+
+	level, option := syscall.IPPROTO_IP, syscall.IP_TTL
+
+	// IPv4 clients of a dual stack socket have an IPv4 address
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		level, option = syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS
+	}
+
+	var sockErr error
+
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), level, option, hopLimit)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
+
+// closeConnWriter closes the connection after the response, so that it is not
+// reused for requests that must not get the hop limit of the token response.
+type closeConnWriter struct {
+	http.ResponseWriter
+}
+
+func (w closeConnWriter) WriteHeader(status int) {
+	w.Header().Set("Connection", "close")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w closeConnWriter) Write(data []byte) (int, error) {
+	w.Header().Set("Connection", "close")
+	return w.ResponseWriter.Write(data)
+}
+
+// handleToken applies the rules of the EC2 metadata service for token
+// requests before the request is forwarded. Token requests that were
+// forwarded by another proxy are rejected, and the response is only sent as
+// far as the hop limit.
+func (p *metadataProxy) handleToken(w http.ResponseWriter, r *http.Request) {
+	if _, found := r.Header["X-Forwarded-For"]; found {
+		log.Warn("Rejecting token request with X-Forwarded-For from ", remoteIP(r.RemoteAddr))
+		writeIMDSError(w, http.StatusForbidden)
+		return
+	}
+
+	if p.tokenHopLimit > 0 {
+		if err := setHopLimit(r, p.tokenHopLimit); err != nil {
+			log.Error("Error setting hop limit for token response: ", err)
+			writeIMDSError(w, http.StatusInternalServerError)
+			return
+		}
+
+		w = closeConnWriter{w}
+	}
+
+	p.proxy(w, r)
+}
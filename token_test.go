@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readIMDSResponse reads a response from testdata. The responses are synthetic,
+// written to match the responses of the EC2 metadata service, not recorded.
+func readIMDSResponse(t *testing.T, name string) (*http.Response, string) {
+	file, err := os.Open(filepath.Join("testdata", "imds", name))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+	resp, err := http.ReadResponse(bufio.NewReader(file), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, string(body)
+}
+
+// newIMDSServer serves the response from testdata for every request and
+// records the headers of the last request.
+func newIMDSServer(t *testing.T, name string, headers *http.Header) *httptest.Server {
+	resp, body := readIMDSResponse(t, name)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*headers = r.Header
+
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+
+		w.WriteHeader(resp.StatusCode)
+		w.Write([]byte(body))
+	}))
+}
+
+func TestTokenRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	var upstreamHeaders http.Header
+	upstream := newIMDSServer(t, "token.http", &upstreamHeaders)
+	defer upstream.Close()
+
+	proxy := newMetadataProxy(upstream.URL, &http.Transport{}, testContainerService{}, newTestConfig())
+
+	expected, expectedBody := readIMDSResponse(t, "token.http")
+	w := testRequest(proxy.Handle, "PUT", "/latest/api/token", "172.17.0.2",
+		"X-aws-ec2-metadata-token-ttl-seconds: 21600",
+		"Connection: keep-alive, X-Private",
+		"X-Private: secret",
+		"Proxy-Authorization: Basic secret")
+	assert.Equal(expected.StatusCode, w.Code)
+	assert.Equal(expectedBody, w.Body.String())
+	assert.Equal("21600", w.Header().Get("X-aws-ec2-metadata-token-ttl-seconds"))
+
+	// Hop-by-hop headers are not forwarded in either direction
+	assert.Equal("21600", upstreamHeaders.Get("X-aws-ec2-metadata-token-ttl-seconds"))
+	assert.Empty(upstreamHeaders.Get("X-Private"))
+	assert.Empty(upstreamHeaders.Get("Proxy-Authorization"))
+	assert.Empty(w.Header().Get("Connection"))
+
+	// Token requests with X-Forwarded-For are rejected like the EC2 metadata service does
+	expected, expectedBody = readIMDSResponse(t, "token-x-forwarded-for.http")
+	w = testRequest(proxy.Handle, "PUT", "/latest/api/token", "172.17.0.2",
+		"X-aws-ec2-metadata-token-ttl-seconds: 21600",
+		"X-Forwarded-For: 10.0.0.1")
+	assert.Equal(expected.StatusCode, w.Code)
+	assert.Equal(expected.Header.Get("Content-Type"), w.Header().Get("Content-Type"))
+	assert.Equal(expectedBody, w.Body.String())
+}
+
+func TestIMDSErrorPage(t *testing.T) {
+	assert := assert.New(t)
+
+	expected, expectedBody := readIMDSResponse(t, "not-found.http")
+	w := httptest.NewRecorder()
+	writeIMDSError(w, http.StatusNotFound)
+
+	assert.Equal(expected.StatusCode, w.Code)
+	assert.Equal(expected.Header.Get("Content-Type"), w.Header().Get("Content-Type"))
+	assert.Equal(expectedBody, w.Body.String())
+}
+
+// socketHopLimit returns the IP TTL, or the IPv6 hop limit, of the connection
+// of the request.
+func socketHopLimit(r *http.Request) (int, error) {
+	conn := r.Context().Value(connContextKey{}).(net.Conn)
+	level, option := syscall.IPPROTO_IP, syscall.IP_TTL
+
+	if conn.LocalAddr().(*net.TCPAddr).IP.To4() == nil {
+		level, option = syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS
+	}
+
+	rawConn, err := conn.(syscall.Conn).SyscallConn()
+
+	if err != nil {
+		return 0, err
+	}
+
+	var hopLimit int
+	var sockErr error
+
+	err = rawConn.Control(func(fd uintptr) {
+		hopLimit, sockErr = syscall.GetsockoptInt(int(fd), level, option)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return hopLimit, sockErr
+}
+
+func TestTokenHopLimit(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		listener, err := net.Listen("tcp", addr)
+
+		if err != nil {
+			t.Logf("Skipping %s: %s", addr, err)
+			continue
+		}
+
+		var hopLimit int
+		var hopLimitErr error
+
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if hopLimitErr = setHopLimit(r, 2); hopLimitErr == nil {
+				hopLimit, hopLimitErr = socketHopLimit(r)
+			}
+		}))
+		server.Listener.Close()
+		server.Listener = listener
+		server.Config.ConnContext = withConn
+		server.Start()
+
+		resp, err := http.Get(server.URL)
+		assert.Nil(t, err, addr)
+		resp.Body.Close()
+		assert.Nil(t, hopLimitErr, addr)
+		assert.Equal(t, 2, hopLimit, addr)
+		server.Close()
+	}
+}
+
+func TestTokenHopLimitClosesConnection(t *testing.T) {
+	assert := assert.New(t)
+
+	var upstreamHeaders http.Header
+	upstream := newIMDSServer(t, "token.http", &upstreamHeaders)
+	defer upstream.Close()
+
+	proxy := newMetadataProxy(upstream.URL, &http.Transport{}, testContainerService{}, newTestConfig())
+	proxy.tokenHopLimit = 2
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(proxy.Handle))
+	server.Config.ConnContext = withConn
+	server.Start()
+	defer server.Close()
+
+	req, _ := http.NewRequest("PUT", server.URL+"/latest/api/token", nil)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	// The connection with the hop limit is not reused
+	assert.True(resp.Close)
+}
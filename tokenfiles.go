@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// Files in the directory of a container in the token directory
+const (
+	containerEnvFile   = "env"
+	containerTokenFile = "token"
+
+	// How often the files are updated for new containers
+	containerTokenFilesInterval = time.Second
+)
+
+var (
+	// Container names that are used as directory names
+	containerDirRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+)
+
+// containerTokenFiles writes the values a container needs to use the ECS and
+// EKS Pod Identity endpoints to <dir>/<container name>, so that the directory
+// can be mounted into the container. Unlike an endpoint that authenticates the
+// container by source IP, a mount can only be read by the container it is
+// made for.
+type containerTokenFiles struct {
+	dir      string
+	platform containerService
+	tokens   *containerTokens
+	// Endpoints the environment file configures
+	credentials bool
+	podIdentity bool
+	metadata    bool
+	// Content of the environment files that are written, by container name
+	written map[string]string
+}
+
+func newContainerTokenFiles(dir string, platform containerService, tokens *containerTokens) (*containerTokenFiles, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &containerTokenFiles{
+		dir:      dir,
+		platform: platform,
+		tokens:   tokens,
+		written:  make(map[string]string),
+	}, nil
+}
+
+// Env returns the environment variables the container needs to use the
+// endpoints, one KEY=VALUE per line.
+func (f *containerTokenFiles) Env(container containerInfo) string {
+	var env bytes.Buffer
+
+	// The SDKs prefer the relative URI, so only one of the endpoints is used
+	if f.credentials {
+		fmt.Fprintf(&env, "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI=%s%s\n", ecsCredentialsPath, f.tokens.ID(container.ID))
+	} else if f.podIdentity {
+		fmt.Fprintf(&env, "AWS_CONTAINER_CREDENTIALS_FULL_URI=http://%s%s\n", podIdentityEndpointIP, podIdentityCredentialsPath)
+	}
+
+	if f.credentials || f.podIdentity {
+		fmt.Fprintf(&env, "AWS_CONTAINER_AUTHORIZATION_TOKEN=%s\n", f.tokens.Token(container.ID))
+	}
+
+	if f.metadata {
+		fmt.Fprintf(&env, "ECS_CONTAINER_METADATA_URI_V4=http://%s%s%s\n", ecsEndpointIP, ecsMetadataPath, f.tokens.ID(container.ID))
+	}
+
+	return env.String()
+}
+
+// Write writes the files of the running containers and removes the files of
+// the containers that are gone. The directories are kept, because they may
+// still be mounted.
+func (f *containerTokenFiles) Write() {
+	running := make(map[string]bool)
+
+	for _, container := range f.platform.Containers() {
+		name := strings.TrimPrefix(container.Name, "/")
+
+		if !containerDirRegex.MatchString(name) {
+			continue
+		}
+
+		running[name] = true
+		env := f.Env(container)
+
+		if f.written[name] == env {
+			continue
+		}
+
+		if err := f.writeContainer(name, container, env); err != nil {
+			log.Error("Error writing token files of container ", container.ID, ": ", err)
+			continue
+		}
+
+		f.written[name] = env
+	}
+
+	dirs, err := ioutil.ReadDir(f.dir)
+
+	if err != nil {
+		log.Error("Error listing container token directory ", f.dir, ": ", err)
+		return
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() || running[dir.Name()] {
+			continue
+		}
+
+		for _, file := range []string{containerEnvFile, containerTokenFile} {
+			if err := os.Remove(filepath.Join(f.dir, dir.Name(), file)); err != nil && !os.IsNotExist(err) {
+				log.Error("Error removing token file of container ", dir.Name(), ": ", err)
+			}
+		}
+
+		delete(f.written, dir.Name())
+	}
+}
+
+func (f *containerTokenFiles) writeContainer(name string, container containerInfo, env string) error {
+	dir := filepath.Join(f.dir, name)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if f.credentials || f.podIdentity {
+		if err := writeFileAtomic(filepath.Join(dir, containerTokenFile), []byte(f.tokens.Token(container.ID)), 0644); err != nil {
+			return err
+		}
+	}
+
+	return writeFileAtomic(filepath.Join(dir, containerEnvFile), []byte(env), 0644)
+}
+
+// Watch writes the files now and then periodically.
+func (f *containerTokenFiles) Watch() {
+	f.Write()
+
+	go func() {
+		for range time.Tick(containerTokenFilesInterval) {
+			f.Write()
+		}
+	}()
+}
+
+// writeFileAtomic replaces the file, so that readers never see a partial file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
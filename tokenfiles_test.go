@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContainerTokenFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ec2metaproxy")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	platform := testContainerService{
+		"172.17.0.2": {ID: "container-a", Name: "/web"},
+		"172.17.0.3": {ID: "container-b", Name: "/../escape"},
+	}
+	tokens, err := newContainerTokens("")
+	assert.Nil(err)
+
+	files, err := newContainerTokenFiles(filepath.Join(dir, "containers"), platform, tokens)
+	assert.Nil(err)
+	files.credentials = true
+	files.metadata = true
+	files.Write()
+
+	readFile := func(path ...string) string {
+		data, err := ioutil.ReadFile(filepath.Join(append([]string{dir, "containers"}, path...)...))
+
+		if err != nil {
+			return ""
+		}
+
+		return string(data)
+	}
+
+	assert.Equal(
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI="+ecsCredentialsPath+tokens.ID("container-a")+"\n"+
+			"AWS_CONTAINER_AUTHORIZATION_TOKEN="+tokens.Token("container-a")+"\n"+
+			"ECS_CONTAINER_METADATA_URI_V4=http://169.254.170.2/v4/"+tokens.ID("container-a")+"\n",
+		readFile("web", containerEnvFile))
+	assert.Equal(tokens.Token("container-a"), readFile("web", containerTokenFile))
+
+	info, err := os.Stat(filepath.Join(dir, "containers"))
+	assert.Nil(err)
+	assert.Equal(os.FileMode(0700), info.Mode().Perm())
+
+	// Names that are not valid directory names are skipped
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "containers"))
+	assert.Nil(err)
+	assert.Len(entries, 1)
+
+	// A new container with the same name gets its own token
+	platform["172.17.0.2"] = containerInfo{ID: "container-c", Name: "/web"}
+	files.Write()
+	assert.Equal(tokens.Token("container-c"), readFile("web", containerTokenFile))
+
+	// The files of stopped containers are removed, but the directory is kept
+	delete(platform, "172.17.0.2")
+	files.Write()
+	assert.Equal("", readFile("web", containerEnvFile))
+	assert.Equal("", readFile("web", containerTokenFile))
+	_, err = os.Stat(filepath.Join(dir, "containers", "web"))
+	assert.Nil(err)
+}
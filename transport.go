@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+type metadataTransportOptions struct {
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
+	// Timeout of the request, including all attempts, the backoff between
+	// them and reading the response body
+	Timeout time.Duration
+	// Timeout of each attempt, including reading the response body
+	AttemptTimeout      time.Duration
+	MaxAttempts         int
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+}
+
+// retryTransport limits the time of requests to the EC2 metadata service and
+// retries GET requests that fail with an error or a server error.
+type retryTransport struct {
+	transport      http.RoundTripper
+	timeout        time.Duration
+	attemptTimeout time.Duration
+	maxAttempts    int
+	backoff        time.Duration
+}
+
+func newMetadataTransport(opts metadataTransportOptions) *retryTransport {
+	transport := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   opts.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ResponseHeaderTimeout: opts.ResponseHeaderTimeout,
+		MaxIdleConns:          opts.MaxIdleConns,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		IdleConnTimeout:       opts.IdleConnTimeout,
+	}
+
+	return &retryTransport{
+		transport:      transport,
+		timeout:        opts.Timeout,
+		attemptTimeout: opts.AttemptTimeout,
+		maxAttempts:    opts.MaxAttempts,
+		backoff:        50 * time.Millisecond,
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempts := 1
+
+	// Only GET requests have no side effects and no body to replay
+	if req.Method == "GET" && t.maxAttempts > 1 {
+		attempts = t.maxAttempts
+	}
+
+	// One deadline for all attempts, so retries do not extend the request
+	cancel := context.CancelFunc(func() {})
+
+	if t.timeout > 0 {
+		var ctx context.Context
+		ctx, cancel = context.WithTimeout(req.Context(), t.timeout)
+		req = req.WithContext(ctx)
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := t.roundTrip(req)
+		retry := err != nil || resp.StatusCode >= http.StatusInternalServerError
+
+		if !retry || attempt >= attempts || req.Context().Err() != nil {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+
+			resp.Body = &cancelBody{resp.Body, cancel}
+			return resp, nil
+		}
+
+		if err != nil {
+			log.Debug("Retrying request to EC2 metadata service ", req.URL.Path, ": ", err)
+		} else {
+			log.Debug("Retrying request to EC2 metadata service ", req.URL.Path, ": ", resp.Status)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(time.Duration(attempt) * t.backoff):
+		case <-req.Context().Done():
+			cancel()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+func (t *retryTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	if t.attemptTimeout <= 0 {
+		return t.transport.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), t.attemptTimeout)
+	resp, err := t.transport.RoundTrip(req.WithContext(ctx))
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &cancelBody{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelBody releases the context of a request when the response body is
+// closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// isTimeout returns true if the error is a timeout.
+func isTimeout(err error) bool {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+
+	return err == context.DeadlineExceeded
+}
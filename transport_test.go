@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryTransport(t *testing.T) {
+	assert := assert.New(t)
+
+	var requests int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+			w.Write([]byte("slow"))
+		case "/slow-error":
+			time.Sleep(100 * time.Millisecond)
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			if atomic.AddInt32(&requests, 1)%3 != 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer upstream.Close()
+
+	transport := newMetadataTransport(metadataTransportOptions{
+		DialTimeout:           time.Second,
+		ResponseHeaderTimeout: time.Second,
+		Timeout:               time.Second,
+		AttemptTimeout:        100 * time.Millisecond,
+		MaxAttempts:           3,
+		MaxIdleConns:          2,
+		IdleConnTimeout:       time.Second,
+	})
+	transport.backoff = time.Millisecond
+
+	req, _ := http.NewRequest("GET", upstream.URL+"/retry", nil)
+	resp, err := transport.RoundTrip(req)
+	assert.Nil(err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("ok", string(body))
+	assert.Equal(int32(3), atomic.LoadInt32(&requests))
+
+	// Requests other than GET are not retried
+	req, _ = http.NewRequest("PUT", upstream.URL+"/retry", nil)
+	resp, err = transport.RoundTrip(req)
+	assert.Nil(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(int32(4), atomic.LoadInt32(&requests))
+
+	req, _ = http.NewRequest("GET", upstream.URL+"/slow", nil)
+	_, err = transport.RoundTrip(req)
+	assert.True(isTimeout(err), "%v", err)
+
+	// The timeout of the request includes all attempts
+	transport.timeout = 300 * time.Millisecond
+	transport.maxAttempts = 10
+	start := time.Now()
+	req, _ = http.NewRequest("GET", upstream.URL+"/slow-error", nil)
+	_, err = transport.RoundTrip(req)
+	assert.True(isTimeout(err), "%v", err)
+	assert.True(time.Since(start) < time.Second, "%s", time.Since(start))
+}
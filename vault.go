@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// vaultCredentialSource gets credentials from the HashiCorp Vault AWS secrets
+// engine. The Vault role must use the assumed_role or federation_token
+// credential type.
+type vaultCredentialSource struct {
+	address     string
+	tokenFile   string
+	mount       string
+	defaultRole string
+	client      *http.Client
+}
+
+type vaultResponse struct {
+	LeaseDuration int64    `json:"lease_duration"`
+	Errors        []string `json:"errors"`
+	Data          struct {
+		AccessKey     string `json:"access_key"`
+		SecretKey     string `json:"secret_key"`
+		SecurityToken string `json:"security_token"`
+	} `json:"data"`
+}
+
+func newVaultCredentialSource(address, tokenFile, mount, defaultRole string, client *http.Client) *vaultCredentialSource {
+	return &vaultCredentialSource{
+		address:     strings.TrimSuffix(address, "/"),
+		tokenFile:   tokenFile,
+		mount:       strings.Trim(mount, "/"),
+		defaultRole: defaultRole,
+		client:      client,
+	}
+}
+
+func (v *vaultCredentialSource) Credentials(req credentialsRequest) (credentials, error) {
+	if len(req.RoleChain) > 0 || len(req.Role.ExternalID) > 0 {
+		return credentials{}, errors.New("Role chains and external ids are not supported by the vault credential source")
+	}
+
+	if len(req.IamPolicy) > 0 {
+		return credentials{}, errors.New("IAM policies are not supported by the vault credential source")
+	}
+
+	vaultRole := req.Container.VaultRole
+
+	if len(vaultRole) == 0 {
+		vaultRole = v.defaultRole
+	}
+
+	if len(vaultRole) == 0 {
+		return credentials{}, errors.New("No Vault role configured for container")
+	}
+
+	token, err := v.token()
+
+	if err != nil {
+		return credentials{}, err
+	}
+
+	params := map[string]string{
+		"ttl":               fmt.Sprintf("%ds", int64(req.Duration/time.Second)),
+		"role_session_name": req.SessionName,
+	}
+
+	if !req.Role.RoleArn.Empty() {
+		params["role_arn"] = req.Role.RoleArn.String()
+	}
+
+	body, err := json.Marshal(params)
+
+	if err != nil {
+		return credentials{}, err
+	}
+
+	httpReq, err := http.NewRequest("POST", fmt.Sprintf("%s/v1/%s/sts/%s", v.address, v.mount, url.PathEscape(vaultRole)), bytes.NewReader(body))
+
+	if err != nil {
+		return credentials{}, err
+	}
+
+	httpReq.Header.Set("X-Vault-Token", token)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	generatedAt := time.Now()
+	resp, err := v.client.Do(httpReq)
+
+	if err != nil {
+		return credentials{}, err
+	}
+
+	defer resp.Body.Close()
+
+	var vaultResp vaultResponse
+
+	if err := json.NewDecoder(resp.Body).Decode(&vaultResp); err != nil {
+		return credentials{}, fmt.Errorf("Error decoding Vault response (%s): %s", resp.Status, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return credentials{}, fmt.Errorf("Error getting credentials from Vault role %s (%s): %s", vaultRole, resp.Status, strings.Join(vaultResp.Errors, "; "))
+	}
+
+	return credentials{
+		AccessKey:   vaultResp.Data.AccessKey,
+		SecretKey:   vaultResp.Data.SecretKey,
+		Token:       vaultResp.Data.SecurityToken,
+		Expiration:  generatedAt.Add(time.Duration(vaultResp.LeaseDuration) * time.Second),
+		GeneratedAt: generatedAt,
+		RoleArn:     req.Role.RoleArn,
+	}, nil
+}
+
+// SupportsIamPolicy returns false, the policy is part of the Vault role.
+func (v *vaultCredentialSource) SupportsIamPolicy() bool {
+	return false
+}
+
+// token reads the Vault token for every request so that it can be renewed by
+// another process, such as Vault agent.
+func (v *vaultCredentialSource) token() (string, error) {
+	if len(v.tokenFile) == 0 {
+		token := os.Getenv("VAULT_TOKEN")
+
+		if len(token) == 0 {
+			return "", errors.New("No Vault token configured")
+		}
+
+		return token, nil
+	}
+
+	token, err := ioutil.ReadFile(v.tokenFile)
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(token)), nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVaultCredentialSource(t *testing.T) {
+	assert := assert.New(t)
+
+	var params map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+
+		if r.Method != "POST" || r.URL.Path != "/v1/aws/sts/app" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":["no role"]}`))
+			return
+		}
+
+		params = nil
+		json.NewDecoder(r.Body).Decode(&params)
+		w.Write([]byte(`{"lease_duration":900,"data":{"access_key":"AKID","secret_key":"SECRET","security_token":"TOKEN"}}`))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "ec2metaproxy")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	tokenFile := filepath.Join(dir, "token")
+	assert.Nil(ioutil.WriteFile(tokenFile, []byte("vault-token\n"), 0600))
+
+	role, _ := newRoleArn("arn:aws:iam::123456789012:role/app")
+	source := newVaultCredentialSource(server.URL+"/", tokenFile, "/aws/", "app", &http.Client{})
+	req := credentialsRequest{
+		Container:   containerInfo{ID: "container-a"},
+		Role:        roleChainLink{RoleArn: role},
+		SessionName: "test-container-a",
+		Duration:    15 * time.Minute,
+	}
+
+	creds, err := source.Credentials(req)
+	assert.Nil(err)
+	assert.Equal("AKID", creds.AccessKey)
+	assert.Equal("SECRET", creds.SecretKey)
+	assert.Equal("TOKEN", creds.Token)
+	assert.Equal(role, creds.RoleArn)
+	assert.Equal(15*time.Minute, creds.Expiration.Sub(creds.GeneratedAt))
+	assert.Equal(map[string]string{"ttl": "900s", "role_session_name": "test-container-a", "role_arn": role.String()}, params)
+
+	// The container selects another Vault role
+	req.Container.VaultRole = "other"
+	_, err = source.Credentials(req)
+	assert.EqualError(err, "Error getting credentials from Vault role other (404 Not Found): no role")
+	req.Container.VaultRole = ""
+
+	// The token is read for every request
+	assert.Nil(ioutil.WriteFile(tokenFile, []byte("expired"), 0600))
+	_, err = source.Credentials(req)
+	assert.EqualError(err, "Error getting credentials from Vault role app (403 Forbidden): permission denied")
+
+	// Without a token file, the token is read from the environment
+	source.tokenFile = ""
+	os.Setenv("VAULT_TOKEN", "vault-token")
+	defer os.Unsetenv("VAULT_TOKEN")
+	_, err = source.Credentials(req)
+	assert.Nil(err)
+
+	source.defaultRole = ""
+	_, err = source.Credentials(req)
+	assert.NotNil(err)
+	source.defaultRole = "app"
+
+	// Policies, role chains and external ids are rejected before calling Vault
+	params = nil
+	_, err = source.Credentials(credentialsRequest{Role: roleChainLink{RoleArn: role}, IamPolicy: `{"Statement":[]}`})
+	assert.NotNil(err)
+	_, err = source.Credentials(credentialsRequest{Role: roleChainLink{RoleArn: role, ExternalID: "id"}})
+	assert.NotNil(err)
+	assert.Nil(params)
+}
+
+func TestVaultDefaultIamPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	platform := testContainerService{
+		"172.17.0.2": {ID: "container-a"},
+		"172.17.0.3": {ID: "container-b", CredentialSource: "vault"},
+	}
+	sources := map[string]credentialSource{
+		"static": newStaticCredentialSource("AKID", "SECRET", "TOKEN"),
+		"vault":  newVaultCredentialSource("http://127.0.0.1:8200", "", "aws", "app", &http.Client{}),
+	}
+	config := newTestConfig()
+	testConfigure(config, func(cfg *reloadableConfig) {
+		cfg.DefaultIamRole, _ = newRoleArn("arn:aws:iam::123456789012:role/app")
+		cfg.DefaultIamPolicy = `{"Statement":[]}`
+	})
+	provider := newCredentialsProvider(platform, sources, "static", config, nil)
+
+	_, iamPolicy, err := provider.ContainerRoles(platform["172.17.0.2"])
+	assert.Nil(err)
+	assert.Equal(`{"Statement":[]}`, iamPolicy)
+
+	// The default policy is not applied to sources that do not support policies
+	_, iamPolicy, err = provider.ContainerRoles(platform["172.17.0.3"])
+	assert.Nil(err)
+	assert.Equal("", iamPolicy)
+}